@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type Attendee struct {
+	ViewerId int32   `json:"viewerId"`
+	Name     string  `json:"name"`
+	LastName string  `json:"lastName"`
+	Email    string  `json:"email"`
+	Watched  float64 `json:"watched"`
+	Percent  float64 `json:"percent,omitempty"`
+}
+
+type AttendanceThreshold struct {
+	MinMinutes float64 `json:"minMinutes,omitempty"`
+	MinPercent float64 `json:"minPercent,omitempty"`
+}
+
+type Attendance struct {
+	EventId     string              `json:"eventId"`
+	GeneratedAt time.Time           `json:"generatedAt"`
+	Threshold   AttendanceThreshold `json:"threshold"`
+	Attendees   []Attendee          `json:"attendees"`
+}
+
+// SignedAttendance carries the attendance list exactly as it was signed, so
+// the signature can be verified against the raw payload bytes.
+type SignedAttendance struct {
+	Payload   json.RawMessage `json:"payload"`
+	Algorithm string          `json:"algorithm"`
+	Signature string          `json:"signature"`
+}
+
+var (
+	ErrNoSigningKey = errors.New("signing key is not configured")
+	// ErrNoSchedule is returned for events without a valid schedule.
+	ErrNoSchedule = errors.New("event has no valid schedule")
+)
+
+func (stat *Stat) SetSigningKey(key []byte) {
+	stat.signingKey = key
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of the payload.
+func (stat *Stat) Sign(payload []byte) (string, error) {
+	if len(stat.signingKey) == 0 {
+		return "", ErrNoSigningKey
+	}
+	mac := hmac.New(sha256.New, stat.signingKey)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// watchedTime sums the sessions of a viewer with reconnects merged. Only the
+// time between start and end counts, unless they are zero.
+func watchedTime(sessions []sessionInterval, start time.Time, end time.Time) time.Duration {
+	var watched time.Duration
+	for _, session := range mergeIntervals(sessions) {
+		from, to := session.join, session.leave
+		if !start.IsZero() && from.Before(start) {
+			from = start
+		}
+		if !end.IsZero() && to.After(end) {
+			to = end
+		}
+		if to.After(from) {
+			watched += to.Sub(from)
+		}
+	}
+	return watched
+}
+
+// schedule returns the scheduled start and end of the event. Events that are
+// unknown, belong to another tenant or have no valid schedule return
+// ErrNoSchedule.
+func (stat *Stat) schedule(eventId string, tenant string) (time.Time, time.Time, error) {
+	sqlStr := `SELECT "scheduledStart", "scheduledEnd" FROM "events" WHERE "eventId" = $1`
+	args := []interface{}{eventId}
+	if tenant != "" {
+		sqlStr += ` AND "tenant" = $2`
+		args = append(args, tenant)
+	}
+	var scheduledStart, scheduledEnd sql.NullString
+	err := stat.conn.QueryRow(sqlStr, args...).Scan(&scheduledStart, &scheduledEnd)
+	if err == sql.ErrNoRows {
+		return time.Time{}, time.Time{}, ErrNoSchedule
+	}
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	start, startErr := time.Parse(time.RFC3339, scheduledStart.String)
+	end, endErr := time.Parse(time.RFC3339, scheduledEnd.String)
+	if startErr != nil || endErr != nil || !end.After(start) {
+		return time.Time{}, time.Time{}, ErrNoSchedule
+	}
+	return start, end, nil
+}
+
+func parseThreshold(options ReportOptions) (AttendanceThreshold, error) {
+	var threshold AttendanceThreshold
+	var err error
+	if s := options.Get("minMinutes"); s != "" {
+		threshold.MinMinutes, err = strconv.ParseFloat(s, 64)
+		if err != nil || threshold.MinMinutes < 0 {
+			return threshold, fmt.Errorf("incorrect minMinutes %q", s)
+		}
+	}
+	if s := options.Get("minPercent"); s != "" {
+		threshold.MinPercent, err = strconv.ParseFloat(s, 64)
+		if err != nil || threshold.MinPercent < 0 || threshold.MinPercent > 100 {
+			return threshold, fmt.Errorf("incorrect minPercent %q", s)
+		}
+	}
+	if threshold.MinMinutes == 0 && threshold.MinPercent == 0 {
+		return threshold, errors.New("minMinutes or minPercent is required")
+	}
+	return threshold, nil
+}
+
+// attendance lists the viewers of the event who watched at least the threshold.
+func (stat *Stat) attendance(eventId string, tenant string, filter *reportFilter, threshold AttendanceThreshold) (*Attendance, error) {
+	// the percentage is shown whenever the schedule is known, but only required
+	// for minPercent. Time outside the schedule does not count.
+	start, end, err := stat.schedule(eventId, tenant)
+	if err == ErrNoSchedule && threshold.MinPercent > 0 {
+		return nil, fmt.Errorf("%w: %v: %v", ErrInvalidReport, eventId, err)
+	} else if err != nil && err != ErrNoSchedule {
+		return nil, err
+	}
+	duration := end.Sub(start)
+
+	events, err := stat.eventViewers(filter)
+	if err != nil {
+		return nil, err
+	}
+	attendance := &Attendance{EventId: eventId, GeneratedAt: time.Now().UTC(), Threshold: threshold, Attendees: []Attendee{}}
+	for _, viewer := range events[eventId] {
+		watched := watchedTime(viewer.sessions, start, end)
+		attendee := Attendee{ViewerId: viewer.ViewerId, Name: viewer.Name, LastName: viewer.LastName, Email: viewer.Email, Watched: watched.Seconds()}
+		if watched.Minutes() < threshold.MinMinutes {
+			continue
+		}
+		if duration > 0 {
+			attendee.Percent = math.Round(float64(watched)/float64(duration)*10000) / 100
+			if attendee.Percent < threshold.MinPercent {
+				continue
+			}
+		}
+		attendance.Attendees = append(attendance.Attendees, attendee)
+	}
+	sort.Slice(attendance.Attendees, func(i, j int) bool {
+		a, b := attendance.Attendees[i], attendance.Attendees[j]
+		if a.LastName == b.LastName {
+			if a.Name == b.Name {
+				return a.ViewerId < b.ViewerId
+			}
+			return a.Name < b.Name
+		}
+		return a.LastName < b.LastName
+	})
+	return attendance, nil
+}
+
+// attendanceRequest reads the threshold and loads the attendance of the requested event.
+func (stat *Stat) attendanceRequest(options ReportOptions, filter *reportFilter) (*Attendance, error) {
+	threshold, err := parseThreshold(options)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidReport, err)
+	}
+	if options.Get("event") == "" {
+		return nil, fmt.Errorf("%w: event is required", ErrInvalidReport)
+	}
+	return stat.attendance(options.Get("event"), options.Tenant, filter, threshold)
+}
+
+func (stat *Stat) attendanceReport(options ReportOptions, filter *reportFilter) (*Table, error) {
+	attendance, err := stat.attendanceRequest(options, filter)
+	if err != nil {
+		return nil, err
+	}
+	table := NewTable("attendance", "viewerId", "name", "lastName", "email", "watched", "percent")
+	for _, attendee := range attendance.Attendees {
+		table.Append(attendee.ViewerId, attendee.Name, attendee.LastName, attendee.Email, attendee.Watched, attendee.Percent)
+	}
+	return table, nil
+}
+
+// signedAttendanceReport returns the attendance list as JSON signed with the
+// configured key. It is not a table, so it bypasses the renderers.
+func (stat *Stat) signedAttendanceReport(options ReportOptions) (*ReportResult, error) {
+	filter, err := newReportFilter(options)
+	if err != nil {
+		return nil, err
+	}
+	attendance, err := stat.attendanceRequest(options, filter)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(attendance)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := stat.Sign(payload)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(SignedAttendance{Payload: payload, Algorithm: "HMAC-SHA256", Signature: signature})
+	if err != nil {
+		return nil, err
+	}
+	return &ReportResult{ContentType: "application/json; charset=utf-8", Body: body}, nil
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// ScopeCollect stores sessions, heartbeats and events
+	ScopeCollect = "collect"
+	// ScopeReport reads reports, events and live metrics
+	ScopeReport = "report"
+	// ScopeAdmin manages API keys
+	ScopeAdmin = "admin"
+)
+
+var scopes = []string{ScopeCollect, ScopeReport, ScopeAdmin}
+
+// tenantKey holds the tenant of the authenticated key in the gin context. Keys
+// without a tenant, and every request while authentication is off, see all tenants.
+const tenantKey = "tenant"
+
+func tenantOf(c *gin.Context) string {
+	return c.GetString(tenantKey)
+}
+
+var (
+	ErrUnauthorized = errors.New("missing or invalid API key")
+	ErrForbidden    = errors.New("event belongs to another tenant")
+)
+
+// APIKey is a stored key. The secret is handed out once on creation and only
+// its SHA-256 hash is stored; keys are presented as "keyId.secret".
+type APIKey struct {
+	KeyId     string   `json:"keyId"`
+	Name      string   `json:"name"`
+	Tenant    string   `json:"tenant"`
+	Scopes    []string `json:"scopes"`
+	CreatedAt string   `json:"createdAt"`
+	RevokedAt *string  `json:"revokedAt,omitempty"`
+	// Key is only set on creation.
+	Key string `json:"key,omitempty"`
+}
+
+func (key *APIKey) HasScope(scope string) bool {
+	for _, s := range key.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ParseScopes reads scopes separated by commas.
+func ParseScopes(s string) ([]string, error) {
+	var parsed []string
+	for _, scope := range strings.Split(s, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" {
+			continue
+		}
+		known := false
+		for _, s := range scopes {
+			known = known || s == scope
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown scope %q", scope)
+		}
+		parsed = append(parsed, scope)
+	}
+	if len(parsed) == 0 {
+		return nil, errors.New("a key needs at least one scope")
+	}
+	return parsed, nil
+}
+
+// CreateAPIKey stores a new key and returns it with its secret.
+func (stat *Stat) CreateAPIKey(name string, tenant string, scopes []string) (*APIKey, error) {
+	keyId, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+	key := &APIKey{KeyId: keyId, Name: name, Tenant: tenant, Scopes: scopes, CreatedAt: storedTime(time.Now()), Key: keyId + "." + secret}
+	_, err = stat.conn.Exec(`INSERT INTO "api_keys"("keyId","hash","name","tenant","scopes","createdAt") VALUES ($1,$2,$3,$4,$5,$6)`,
+		key.KeyId, hashSecret(secret), key.Name, key.Tenant, strings.Join(key.Scopes, ","), key.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// APIKeys lists the keys of a tenant, or of all tenants for an empty one.
+func (stat *Stat) APIKeys(tenant string) ([]APIKey, error) {
+	sqlStr := `SELECT "keyId", COALESCE("name", ''), "tenant", "scopes", "createdAt", "revokedAt" FROM "api_keys"`
+	var args []interface{}
+	if tenant != "" {
+		sqlStr += ` WHERE "tenant" = $1`
+		args = append(args, tenant)
+	}
+	rows, err := stat.conn.Query(sqlStr+` ORDER BY "createdAt"`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			log.Printf("Close failed: %v\n", err)
+		}
+	}(rows)
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var key APIKey
+		var keyScopes string
+		var revokedAt sql.NullString
+		err := rows.Scan(&key.KeyId, &key.Name, &key.Tenant, &keyScopes, &key.CreatedAt, &revokedAt)
+		if err != nil {
+			return nil, err
+		}
+		key.Scopes = strings.Split(keyScopes, ",")
+		if revokedAt.Valid {
+			key.RevokedAt = &revokedAt.String
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey revokes a key of a tenant, or of any tenant for an empty one.
+// It returns sql.ErrNoRows for unknown or already revoked keys.
+func (stat *Stat) RevokeAPIKey(keyId string, tenant string) error {
+	sqlStr := `UPDATE "api_keys" SET "revokedAt" = $1 WHERE "keyId" = $2 AND "revokedAt" IS NULL`
+	args := []interface{}{storedTime(time.Now()), keyId}
+	if tenant != "" {
+		sqlStr += ` AND "tenant" = $3`
+		args = append(args, tenant)
+	}
+	result, err := stat.conn.Exec(sqlStr, args...)
+	if err != nil {
+		return err
+	}
+	revoked, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if revoked == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// authenticate looks up the key presented as "keyId.secret".
+func (stat *Stat) authenticate(presented string) (*APIKey, error) {
+	split := strings.SplitN(presented, ".", 2)
+	if len(split) != 2 {
+		return nil, ErrUnauthorized
+	}
+	var key APIKey
+	var hash, keyScopes string
+	var revokedAt sql.NullString
+	err := stat.conn.QueryRow(`SELECT "keyId", "hash", "tenant", "scopes", "revokedAt" FROM "api_keys" WHERE "keyId" = $1`, split[0]).
+		Scan(&key.KeyId, &hash, &key.Tenant, &keyScopes, &revokedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrUnauthorized
+	}
+	if err != nil {
+		return nil, err
+	}
+	if revokedAt.Valid || subtle.ConstantTimeCompare([]byte(hash), []byte(hashSecret(split[1]))) != 1 {
+		return nil, ErrUnauthorized
+	}
+	key.Scopes = strings.Split(keyScopes, ",")
+	return &key, nil
+}
+
+// presentedKey reads the key from "Authorization: Bearer" or X-API-Key.
+func presentedKey(c *gin.Context) string {
+	if authorization := c.GetHeader("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+	}
+	return c.GetHeader("X-API-Key")
+}
+
+// Authorize admits requests whose key has the scope and puts the tenant of the
+// key into the context. Everything is admitted while authentication is off.
+func (stat *Stat) Authorize(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !stat.authRequired {
+			c.Next()
+			return
+		}
+		key, err := stat.authenticate(presentedKey(c))
+		if err == ErrUnauthorized {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"result": "unauthorized"})
+			return
+		}
+		if err != nil {
+			log.Printf("Authorize failed: %v\n", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"result": "failed"})
+			return
+		}
+		if !key.HasScope(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"result": "forbidden"})
+			return
+		}
+		c.Set(tenantKey, key.Tenant)
+		c.Next()
+	}
+}
+
+// queryExecer is a connection or a transaction.
+type queryExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// claimEvent checks that a tenant may write to an event and returns the tenant
+// the event belongs to. An event seen for the first time is recorded as
+// belonging to the tenant. Keys without a tenant write to any event.
+func (stat *Stat) claimEvent(conn queryExecer, eventId string, tenant string) (string, error) {
+	var owner string
+	err := conn.QueryRow(`SELECT "tenant" FROM "events" WHERE "eventId" = $1`, eventId).Scan(&owner)
+	if err == sql.ErrNoRows {
+		_, err = conn.Exec(`INSERT INTO "events"("eventId","tenant") VALUES ($1,$2)`, eventId, tenant)
+		return tenant, err
+	}
+	if err != nil {
+		return "", err
+	}
+	if tenant != "" && owner != tenant {
+		return "", ErrForbidden
+	}
+	return owner, nil
+}
+
+// ownsEvent tells whether a tenant may read an event, which it may if the
+// event exists and belongs to it. Keys without a tenant read any event.
+func (stat *Stat) ownsEvent(eventId string, tenant string) (bool, error) {
+	if tenant == "" {
+		return true, nil
+	}
+	var owner string
+	err := stat.conn.QueryRow(`SELECT "tenant" FROM "events" WHERE "eventId" = $1`, eventId).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return owner == tenant, nil
+}
+
+func (stat *Stat) Keys(c *gin.Context) {
+	keys, err := stat.APIKeys(tenantOf(c))
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal server error")
+		log.Printf("Keys failed: %v\n", err)
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+type keyRequest struct {
+	Name   string   `json:"name"`
+	Tenant *string  `json:"tenant"`
+	Scopes []string `json:"scopes"`
+}
+
+// CreateKey creates a key of the tenant of the admin key. Admin keys without a
+// tenant create keys of any tenant, or without one when none is given.
+func (stat *Stat) CreateKey(c *gin.Context) {
+	var request keyRequest
+	err := c.BindJSON(&request)
+	if err != nil {
+		log.Printf("CreateKey failed: %v\n", err)
+		c.JSON(http.StatusBadRequest, gin.H{"result": "failed"})
+		return
+	}
+	tenant := tenantOf(c)
+	if request.Tenant != nil && *request.Tenant != tenant {
+		if tenant != "" {
+			c.JSON(http.StatusForbidden, gin.H{"result": "forbidden"})
+			return
+		}
+		tenant = *request.Tenant
+	}
+	keyScopes, err := ParseScopes(strings.Join(request.Scopes, ","))
+	if err != nil {
+		log.Printf("CreateKey failed: %v\n", err)
+		c.JSON(http.StatusBadRequest, gin.H{"result": "failed"})
+		return
+	}
+
+	key, err := stat.CreateAPIKey(request.Name, tenant, keyScopes)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal server error")
+		log.Printf("CreateKey failed: %v\n", err)
+		return
+	}
+	c.JSON(http.StatusOK, key)
+}
+
+func (stat *Stat) RevokeKey(c *gin.Context) {
+	err := stat.RevokeAPIKey(c.Param("key"), tenantOf(c))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"result": "not found"})
+		return
+	}
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal server error")
+		log.Printf("RevokeKey failed: %v\n", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"result": "success"})
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// CollectAtomic stores the whole batch or nothing
+	CollectAtomic = "atomic"
+	// CollectPartial stores every record that can be stored and reports the rest
+	CollectPartial = "partial"
+)
+
+const (
+	// ConflictReject fails records whose session is already stored
+	ConflictReject = "reject"
+	// ConflictMerge merges re-sent records into the stored session
+	ConflictMerge = "merge"
+)
+
+const (
+	RecordOk         = "ok"
+	RecordFailed     = "failed"
+	RecordRolledBack = "rolledBack"
+)
+
+type CollectOptions struct {
+	Mode     string
+	Conflict string
+	// Tenant the sessions are stored for, empty for keys without a tenant
+	Tenant string
+}
+
+// Validate names the first option that is not supported.
+func (options CollectOptions) Validate() error {
+	if options.Mode != CollectAtomic && options.Mode != CollectPartial {
+		return fmt.Errorf("incorrect mode %q", options.Mode)
+	}
+	if options.Conflict != ConflictReject && options.Conflict != ConflictMerge {
+		return fmt.Errorf("incorrect conflict %q", options.Conflict)
+	}
+	return nil
+}
+
+func collectOptions(c *gin.Context) (CollectOptions, error) {
+	options := CollectOptions{
+		Mode:     c.DefaultQuery("mode", CollectAtomic),
+		Conflict: c.DefaultQuery("conflict", ConflictReject),
+		Tenant:   tenantOf(c),
+	}
+	return options, options.Validate()
+}
+
+type CollectRecord struct {
+	ViewerId int32  `json:"viewerId"`
+	JoinTime string `json:"joinTime"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+type CollectResult struct {
+	Result  string          `json:"result"`
+	Records []CollectRecord `json:"records"`
+}
+
+func (result *CollectResult) Failed() int {
+	var failed int
+	for _, record := range result.Records {
+		if record.Status == RecordFailed {
+			failed++
+		}
+	}
+	return failed
+}
+
+// storedTime formats a time the way session times are stored: RFC3339 in UTC,
+// so that stored times compare correctly as text.
+func storedTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// nullString stores an empty string as NULL, which time columns accept.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// normaliseTimes converts the join and leave times of a viewer to UTC. A
+// missing leave time is kept empty.
+func normaliseTimes(t *Viewer) error {
+	joinTime, err := time.Parse(time.RFC3339, t.JoinTime)
+	if err != nil {
+		return fmt.Errorf("incorrect joinTime %q", t.JoinTime)
+	}
+	t.JoinTime = storedTime(joinTime)
+	if t.LeaveTime == "" {
+		return nil
+	}
+	leaveTime, err := time.Parse(time.RFC3339, t.LeaveTime)
+	if err != nil {
+		return fmt.Errorf("incorrect leaveTime %q", t.LeaveTime)
+	}
+	t.LeaveTime = storedTime(leaveTime)
+	return nil
+}
+
+// later returns the later of two RFC3339 times, preferring b when a cannot be parsed.
+func later(a string, b string) string {
+	at, err := time.Parse(time.RFC3339, a)
+	if err != nil {
+		return b
+	}
+	bt, err := time.Parse(time.RFC3339, b)
+	if err != nil || at.After(bt) {
+		return a
+	}
+	return b
+}
+
+func mergeString(stored string, incoming string) string {
+	if incoming == "" {
+		return stored
+	}
+	return incoming
+}
+
+func mergePointer(stored *string, incoming *string) *string {
+	if incoming == nil {
+		return stored
+	}
+	return incoming
+}
+
+func mergeResolution(stored Resolution, incoming Resolution) Resolution {
+	if incoming.X == 0 && incoming.Y == 0 {
+		return stored
+	}
+	return incoming
+}
+
+// mergeViewer combines a re-sent record with the stored one: the session is
+// extended to the latest leaveTime, counters keep their maximum and fields
+// missing from the incoming record keep their stored values.
+func mergeViewer(stored Viewer, incoming Viewer) Viewer {
+	merged := incoming
+	merged.Name = mergeString(stored.Name, incoming.Name)
+	merged.LastName = mergeString(stored.LastName, incoming.LastName)
+	merged.Email = mergeString(stored.Email, incoming.Email)
+	merged.IsChatName = stored.IsChatName || incoming.IsChatName
+	merged.IsChatEmail = stored.IsChatEmail || incoming.IsChatEmail
+	merged.LeaveTime = later(stored.LeaveTime, incoming.LeaveTime)
+	if stored.SpentTime > incoming.SpentTime {
+		merged.SpentTime = stored.SpentTime
+	}
+	if stored.ChatCommentsTotal > incoming.ChatCommentsTotal {
+		merged.ChatCommentsTotal = stored.ChatCommentsTotal
+	}
+	if incoming.SpentTimeDeltaPercent == 0 {
+		merged.SpentTimeDeltaPercent = stored.SpentTimeDeltaPercent
+	}
+	if incoming.ChatCommentsDeltaPercent == 0 {
+		merged.ChatCommentsDeltaPercent = stored.ChatCommentsDeltaPercent
+	}
+	if len(incoming.AnotherFields) == 0 {
+		merged.AnotherFields = stored.AnotherFields
+	}
+
+	merged.UserIP = mergeString(stored.UserIP, incoming.UserIP)
+	merged.UserCountry = mergeString(stored.UserCountry, incoming.UserCountry)
+	merged.UserCity = mergeString(stored.UserCity, incoming.UserCity)
+	merged.UserRegion = mergeString(stored.UserRegion, incoming.UserRegion)
+	merged.UserProvider = mergeString(stored.UserProvider, incoming.UserProvider)
+	merged.Platform.Name = mergePointer(stored.Platform.Name, incoming.Platform.Name)
+	merged.Platform.Version = mergePointer(stored.Platform.Version, incoming.Platform.Version)
+	merged.Platform.Architecture = mergePointer(stored.Platform.Architecture, incoming.Platform.Architecture)
+	merged.BrowserClient.Name = mergePointer(stored.BrowserClient.Name, incoming.BrowserClient.Name)
+	merged.BrowserClient.Version = mergePointer(stored.BrowserClient.Version, incoming.BrowserClient.Version)
+	merged.ScreenDataViewPort = mergeResolution(stored.ScreenDataViewPort, incoming.ScreenDataViewPort)
+	merged.ScreenDataResolution = mergeResolution(stored.ScreenDataResolution, incoming.ScreenDataResolution)
+	return merged
+}
+
+// viewersJoin joins the profile of the viewer of a session "s", which is kept
+// by the tenant the event belongs to.
+const viewersJoin = ` LEFT JOIN "viewers" v ON v."viewerId" = s."viewerId" AND v."tenant" = COALESCE((SELECT e."tenant" FROM "events" e WHERE e."eventId" = s."eventId"), '')`
+
+// loadViewer reads a stored session together with the viewer profile.
+func (stat *Stat) loadViewer(tx *sql.Tx, eventId string, viewerId int32, joinTime string) (*Viewer, error) {
+	sqlStr := `SELECT s."eventId", s."viewerId", COALESCE(v."name", ''), COALESCE(v."lastName", ''), COALESCE(v."isChatName", false), COALESCE(v."email", ''), COALESCE(v."isChatEmail", false), s."joinTime", s."leaveTime", COALESCE(s."spentTime", 0), COALESCE(s."spentTimeDeltaPercent", 0), COALESCE(s."chatCommentsTotal", 0), COALESCE(s."chatCommentsDeltaPercent", 0), s."anotherFields", COALESCE(s."userIP", ''), COALESCE(s."userCountry", ''), COALESCE(s."userCity", ''), COALESCE(s."userRegion", ''), COALESCE(s."userProvider", ''), s."platformName", s."platformVersion", s."platformArchitecture", s."browserClientName", s."browserClientVersion", COALESCE(s."screenData_viewPortX", 0), COALESCE(s."screenData_viewPortY", 0), COALESCE(s."screenData_resolutionX", 0), COALESCE(s."screenData_resolutionY", 0) FROM "stats" s` + viewersJoin + ` WHERE s."eventId" = $1 AND s."viewerId" = $2 AND s."joinTime" = $3`
+	var t Viewer
+	var leaveTime sql.NullString
+	var anotherFields []byte
+
+	err := tx.QueryRow(sqlStr, eventId, viewerId, joinTime).Scan(&t.EventId, &t.ViewerId, &t.Name, &t.LastName, &t.IsChatName, &t.Email, &t.IsChatEmail, &t.JoinTime, &leaveTime, &t.SpentTime, &t.SpentTimeDeltaPercent, &t.ChatCommentsTotal, &t.ChatCommentsDeltaPercent, &anotherFields, &t.UserIP, &t.UserCountry, &t.UserCity, &t.UserRegion, &t.UserProvider, &t.Platform.Name, &t.Platform.Version, &t.Platform.Architecture, &t.BrowserClient.Name, &t.BrowserClient.Version, &t.ScreenDataViewPort.X, &t.ScreenDataViewPort.Y, &t.ScreenDataResolution.X, &t.ScreenDataResolution.Y)
+	if err != nil {
+		return nil, err
+	}
+	t.LeaveTime = leaveTime.String
+	if len(anotherFields) > 0 {
+		err = json.Unmarshal(anotherFields, &t.AnotherFields)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &t, nil
+}
+
+// updateViewer updates a stored session and the profile of the viewer kept by
+// the tenant of the event.
+func (stat *Stat) updateViewer(tx *sql.Tx, t Viewer, tenant string) error {
+	viewerSql := `UPDATE viewers SET "name" = $1, "lastName" = $2, "isChatName" = $3, "email" = $4, "isChatEmail" = $5 WHERE "tenant" = $6 AND "viewerId" = $7`
+	sessionSql := `UPDATE stats SET "leaveTime" = $1, "spentTime" = $2, "spentTimeDeltaPercent" = $3, "chatCommentsTotal" = $4, "chatCommentsDeltaPercent" = $5, "anotherFields" = $6, "userIP" = $7, "userCountry" = $8, "userCity" = $9, "userRegion" = $10, "userProvider" = $11, "platformName" = $12, "platformVersion" = $13, "platformArchitecture" = $14, "browserClientName" = $15, "browserClientVersion" = $16, "screenData_viewPortX" = $17, "screenData_viewPortY" = $18, "screenData_resolutionX" = $19, "screenData_resolutionY" = $20 WHERE "eventId" = $21 AND "viewerId" = $22 AND "joinTime" = $23`
+
+	anotherFields, _ := json.Marshal(t.AnotherFields)
+	_, err := tx.Exec(viewerSql, t.Name, t.LastName, t.IsChatName, t.Email, t.IsChatEmail, tenant, t.ViewerId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(sessionSql, nullString(t.LeaveTime), t.SpentTime, t.SpentTimeDeltaPercent, t.ChatCommentsTotal, t.ChatCommentsDeltaPercent, anotherFields, t.UserIP, t.UserCountry, t.UserCity, t.UserRegion, t.UserProvider, t.Platform.Name, t.Platform.Version, t.Platform.Architecture, t.BrowserClient.Name, t.BrowserClient.Version, t.ScreenDataViewPort.X, t.ScreenDataViewPort.Y, t.ScreenDataResolution.X, t.ScreenDataResolution.Y, t.EventId, t.ViewerId, t.JoinTime)
+	return err
+}
+
+// upsertViewer merges the record into an already stored session or inserts a new one.
+func (stat *Stat) upsertViewer(tx *sql.Tx, t Viewer, tenant string) error {
+	stored, err := stat.loadViewer(tx, t.EventId, t.ViewerId, t.JoinTime)
+	if err == sql.ErrNoRows {
+		return stat.insertViewer(tx, t, tenant)
+	}
+	if err != nil {
+		return err
+	}
+	return stat.updateViewer(tx, mergeViewer(*stored, t), tenant)
+}
+
+// insertViewer stores a new session. Profiles are kept per tenant, so a viewer
+// id sent to the events of one tenant never changes what another tenant sees.
+func (stat *Stat) insertViewer(tx *sql.Tx, t Viewer, tenant string) error {
+	viewerSql := `INSERT INTO viewers("tenant","viewerId","name","lastName","isChatName","email","isChatEmail") VALUES ($1,$2,$3,$4,$5,$6,$7) ` + stat.storage.OnConflict("tenant", "viewerId") + ` "name" = COALESCE(NULLIF(` + stat.storage.Excluded("name") + `, ''), viewers."name"), "lastName" = COALESCE(NULLIF(` + stat.storage.Excluded("lastName") + `, ''), viewers."lastName"), "isChatName" = ` + stat.storage.Excluded("isChatName") + `, "email" = COALESCE(NULLIF(` + stat.storage.Excluded("email") + `, ''), viewers."email"), "isChatEmail" = ` + stat.storage.Excluded("isChatEmail")
+	sessionSql := `INSERT INTO stats("eventId","viewerId","joinTime","leaveTime","spentTime","spentTimeDeltaPercent","chatCommentsTotal","chatCommentsDeltaPercent","anotherFields","userIP","userCountry","userCity","userRegion","userProvider","platformName","platformVersion","platformArchitecture","browserClientName","browserClientVersion","screenData_viewPortX","screenData_viewPortY","screenData_resolutionX","screenData_resolutionY") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,$18,$19,$20,$21,$22,$23)`
+
+	anotherFields, _ := json.Marshal(t.AnotherFields)
+	_, err := tx.Exec(viewerSql, tenant, t.ViewerId, t.Name, t.LastName, t.IsChatName, t.Email, t.IsChatEmail)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(sessionSql, t.EventId, t.ViewerId, t.JoinTime, nullString(t.LeaveTime), t.SpentTime, t.SpentTimeDeltaPercent, t.ChatCommentsTotal, t.ChatCommentsDeltaPercent, anotherFields, t.UserIP, t.UserCountry, t.UserCity, t.UserRegion, t.UserProvider, t.Platform.Name, t.Platform.Version, t.Platform.Architecture, t.BrowserClient.Name, t.BrowserClient.Version, t.ScreenDataViewPort.X, t.ScreenDataViewPort.Y, t.ScreenDataResolution.X, t.ScreenDataResolution.Y)
+	return err
+}
+
+// storeViewer stores one session inside a savepoint, so a failed record is
+// rolled back alone and the surrounding transaction stays usable. The event is
+// claimed for the tenant of the options and the viewer profile is kept for the
+// tenant owning it. With ConflictReject a session that is already stored fails
+// the record, with ConflictMerge it is updated by upsertViewer. Stored sessions
+// mark the rollups of their event stale.
+func (stat *Stat) storeViewer(tx *sql.Tx, t Viewer, options CollectOptions) error {
+	_, err := tx.Exec(`SAVEPOINT viewer`)
+	if err != nil {
+		return err
+	}
+	tenant, err := stat.claimEvent(tx, t.EventId, options.Tenant)
+	if err == nil && options.Conflict == ConflictMerge {
+		err = stat.upsertViewer(tx, t, tenant)
+	} else if err == nil {
+		err = stat.insertViewer(tx, t, tenant)
+	}
+	if err == nil {
+		err = stat.markRollup(tx, t.EventId, t.JoinTime)
+	}
+	if err != nil {
+		_, rollbackErr := tx.Exec(`ROLLBACK TO SAVEPOINT viewer`)
+		if rollbackErr != nil {
+			log.Printf("Rollback failed: %v\n", rollbackErr)
+		}
+		return err
+	}
+	_, err = tx.Exec(`RELEASE SAVEPOINT viewer`)
+	return err
+}
+
+// StoreViewers writes a batch of viewers in one transaction. In CollectAtomic mode
+// the transaction is rolled back if any record fails.
+func (stat *Stat) StoreViewers(targets []Viewer, options CollectOptions) (*CollectResult, error) {
+	tx, err := stat.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &CollectResult{Records: make([]CollectRecord, 0, len(targets))}
+	for _, t := range targets {
+		record := CollectRecord{ViewerId: t.ViewerId, JoinTime: t.JoinTime, Status: RecordOk}
+		err = normaliseTimes(&t)
+		if err == nil {
+			err = stat.storeViewer(tx, t, options)
+		}
+		if err != nil {
+			log.Printf("Collect %v failed: %v\n", t.ViewerId, err)
+			record.Status = RecordFailed
+			record.Error = err.Error()
+		}
+		result.Records = append(result.Records, record)
+	}
+
+	failed := result.Failed()
+	if failed > 0 && options.Mode == CollectAtomic {
+		err = tx.Rollback()
+		if err != nil {
+			return nil, err
+		}
+		for i := range result.Records {
+			if result.Records[i].Status == RecordOk {
+				result.Records[i].Status = RecordRolledBack
+			}
+		}
+		result.Result = "failed"
+		return result, nil
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	if failed > 0 {
+		result.Result = "partial"
+	} else {
+		result.Result = "success"
+	}
+	return result, nil
+}
+
+func (stat *Stat) Collect(c *gin.Context) {
+	var targets []Viewer
+
+	options, err := collectOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"result": "failed", "error": err.Error()})
+		return
+	}
+
+	err = c.BindJSON(&targets)
+	if err != nil {
+		log.Printf("Collect failed: %v\n", err)
+		c.JSON(http.StatusBadRequest, gin.H{"result": "failed"})
+		return
+	}
+
+	if c.Param("event") != "" {
+		for i := range targets {
+			targets[i].EventId = c.Param("event")
+		}
+	}
+	stat.enricher.Enrich(targets)
+
+	result, err := stat.StoreViewers(targets, options)
+	if err != nil {
+		log.Printf("Collect failed: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"result": "failed"})
+		return
+	}
+	if result.Result == "failed" {
+		c.JSON(http.StatusBadRequest, result)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
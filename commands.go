@@ -0,0 +1,414 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/golang-migrate/migrate/v4"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout bounds how long the server waits for running requests when
+// it is interrupted.
+const shutdownTimeout = 10 * time.Second
+
+// serveCommand runs the HTTP server until it is interrupted:
+//
+//	pikemedia-stat [-addr :81] serve
+//
+// On SIGINT or SIGTERM it stops accepting requests, closes the live streams
+// and stores the sessions of the viewers still present.
+func serveCommand(stat *Stat, config *Config) error {
+	// presence, rollups and retention are watched for the lifetime of the server
+	stop := make(chan struct{})
+	go stat.WatchPresence(config.Presence.Timeout.Duration/2, stop)
+	go stat.WatchRollups(config.Rollups.Interval.Duration, stop)
+	if config.Retention.MaxAge.Duration > 0 {
+		go stat.WatchRetention(config.Retention.MaxAge.Duration, config.Retention.Interval.Duration, stop)
+	}
+
+	// requests share a context cancelled on shutdown, which ends the live streams
+	base, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := &http.Server{
+		Addr:        config.Listen,
+		Handler:     stat.Router(),
+		BaseContext: func(net.Listener) context.Context { return base },
+	}
+	server.RegisterOnShutdown(cancel)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ListenAndServe()
+	}()
+
+	var err error
+	select {
+	case err = <-served:
+	case <-signals:
+		log.Printf("Shutting down\n")
+		ctx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+		err = server.Shutdown(ctx)
+		cancelShutdown()
+	}
+	close(stop)
+	stat.FlushPresence()
+	return err
+}
+
+// migrateCommand manages the schema with the migrations built into the binary:
+//
+//	pikemedia-stat migrate up [n] | down [n] | goto version | version | force version
+//
+// up applies n or all pending migrations, down rolls back n migrations, one by
+// default, and force sets the version without migrating, to clear a dirty state.
+func migrateCommand(stat *Stat, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: pikemedia-stat migrate up [n] | down [n] | goto version | version | force version")
+	}
+	_ = flags.Parse(args)
+	number := func(i int, required bool, fallback int) int {
+		if flags.NArg() <= i {
+			if required {
+				flags.Usage()
+				os.Exit(2)
+			}
+			return fallback
+		}
+		n, err := strconv.Atoi(flags.Arg(i))
+		if err != nil || n < 0 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		return n
+	}
+
+	m, err := stat.migrator()
+	if err != nil {
+		return err
+	}
+	switch flags.Arg(0) {
+	case "up":
+		if n := number(1, false, 0); n > 0 {
+			err = m.Steps(n)
+		} else {
+			err = m.Up()
+		}
+	case "down":
+		err = m.Steps(-number(1, false, 1))
+	case "goto":
+		err = m.Migrate(uint(number(1, true, 0)))
+	case "force":
+		err = m.Force(number(1, true, 0))
+	case "version":
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err == migrate.ErrNoChange {
+		log.Printf("No change\n")
+	} else if err != nil {
+		return err
+	}
+
+	version, dirty, err := m.Version()
+	if err == migrate.ErrNilVersion {
+		fmt.Println("no migrations applied")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if dirty {
+		fmt.Printf("%d (dirty)\n", version)
+	} else {
+		fmt.Println(version)
+	}
+	return nil
+}
+
+// importFormat picks the format of an export from its file name.
+func importFormat(path string) string {
+	switch filepath.Ext(strings.TrimSuffix(path, ".gz")) {
+	case ".json":
+		return "json"
+	case ".ndjson", ".jsonl":
+		return "ndjson"
+	default:
+		return "csv"
+	}
+}
+
+// importCommand loads exports of viewers into the database:
+//
+//	pikemedia-stat import [-event id] [-format csv|json|ndjson] [-map field=header,...] [-delimiter ;] export.csv[.gz]...
+//
+// Without -format the format follows the file name: .json holds an array of
+// viewers as sent to /collect, .ndjson and .jsonl one viewer per line and
+// anything else is read as CSV. A result is printed for every file.
+func importCommand(stat *Stat, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	eventId := flags.String("event", "", "event the viewers belong to")
+	format := flags.String("format", "", "format of the files: csv, json or ndjson")
+	columns := flags.String("map", "", "column mapping as field=header pairs separated by commas")
+	delimiterFlag := flags.String("delimiter", ",", "CSV field delimiter")
+	mode := flags.String("mode", CollectPartial, "batch mode: atomic or partial")
+	conflict := flags.String("conflict", ConflictReject, "duplicate sessions: reject or merge")
+	batchSize := flags.Int("batch", defaultStreamBatch, "number of viewers stored per transaction")
+	tenant := flags.String("tenant", "", "tenant new events are recorded for, events of other tenants are rejected")
+	_ = flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	options := CollectOptions{Mode: *mode, Conflict: *conflict, Tenant: *tenant}
+	err := options.Validate()
+	if err != nil {
+		return err
+	}
+	mapping, err := ParseCSVMapping(*columns)
+	if err != nil {
+		return err
+	}
+	delimiter, err := parseDelimiter(*delimiterFlag)
+	if err != nil {
+		return err
+	}
+	newSource := map[string]func(r io.Reader) (ViewerSource, error){
+		"csv": func(r io.Reader) (ViewerSource, error) {
+			return NewCSVSource(r, mapping, delimiter)
+		},
+		"json": func(r io.Reader) (ViewerSource, error) {
+			return NewJSONSource(r)
+		},
+		"ndjson": func(r io.Reader) (ViewerSource, error) {
+			return NewNDJSONSource(r), nil
+		},
+	}
+	if _, ok := newSource[*format]; *format != "" && !ok {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	for _, path := range flags.Args() {
+		fileFormat := *format
+		if fileFormat == "" {
+			fileFormat = importFormat(path)
+		}
+		result, err := importFile(stat, path, newSource[fileFormat], *eventId, *batchSize, options)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		err = encoder.Encode(result)
+		if err != nil {
+			return err
+		}
+	}
+	// rollups are otherwise only refreshed by a running server
+	return stat.RefreshRollups()
+}
+
+func importFile(stat *Stat, path string, newSource func(r io.Reader) (ViewerSource, error), eventId string, batchSize int, options CollectOptions) (*StreamResult, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			log.Printf("Close failed: %v\n", err)
+		}
+	}(file)
+	var r io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		r, err = gzip.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	source, err := newSource(r)
+	if err != nil {
+		return nil, err
+	}
+	return stat.Ingest(source, eventId, batchSize, options)
+}
+
+// reportCommand runs a /report query without the server and writes the result:
+//
+//	pikemedia-stat report [-o file] name=value...
+//
+// The arguments are the query parameters of /report, such as column=platformName
+// event=webinar format=json; an argument may also hold a whole query string.
+func reportCommand(stat *Stat, args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("report", flag.ExitOnError)
+	output := flags.String("o", "", "file the report is written to instead of the standard output")
+	_ = flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	query := url.Values{}
+	for _, arg := range flags.Args() {
+		values, err := url.ParseQuery(arg)
+		if err != nil {
+			return err
+		}
+		for name, value := range values {
+			query[name] = append(query[name], value...)
+		}
+	}
+
+	err := stat.RefreshRollups()
+	if err != nil {
+		return err
+	}
+	result, err := stat.RunReport(ReportOptions{Values: query})
+	if err != nil {
+		return err
+	}
+
+	if *output != "" {
+		return os.WriteFile(*output, result.Body, 0644)
+	}
+	_, err = w.Write(result.Body)
+	return err
+}
+
+// purgeCommand deletes the sessions of an event, the sessions that joined
+// before a time or both, together with viewers left without sessions:
+//
+//	pikemedia-stat purge [-event id] [-before time]
+func purgeCommand(stat *Stat, args []string) error {
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	eventId := flags.String("event", "", "event whose sessions are deleted")
+	beforeFlag := flags.String("before", "", "sessions that joined before this time are deleted")
+	_ = flags.Parse(args)
+	if flags.NArg() != 0 || (*eventId == "" && *beforeFlag == "") {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var before time.Time
+	if *beforeFlag != "" {
+		var err error
+		before, err = parseReportTime(*beforeFlag, time.UTC)
+		if err != nil {
+			return err
+		}
+	}
+	purged, err := stat.Purge(*eventId, before)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d sessions purged\n", purged)
+	return nil
+}
+
+// backupCommand writes a backup of the database to a file that must not exist yet:
+//
+//	pikemedia-stat backup file
+func backupCommand(stat *Stat, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	_, err := os.Stat(flags.Arg(0))
+	if err == nil {
+		return fmt.Errorf("%s already exists", flags.Arg(0))
+	}
+	return stat.storage.Backup(flags.Arg(0))
+}
+
+// keysCommand manages API keys. The secret of a key is only printed when it is
+// created:
+//
+//	pikemedia-stat keys create [-name name] [-tenant tenant] -scopes collect,report,admin
+//	pikemedia-stat keys list [-tenant tenant]
+//	pikemedia-stat keys revoke keyId
+func keysCommand(stat *Stat, args []string, w io.Writer) error {
+	usage := "usage: pikemedia-stat keys create [-name name] [-tenant tenant] -scopes scopes | list [-tenant tenant] | revoke keyId"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	flags := flag.NewFlagSet("keys "+args[0], flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	switch args[0] {
+	case "create":
+		name := flags.String("name", "", "what the key is used for")
+		tenant := flags.String("tenant", "", "tenant the key is bound to, without one the key sees all tenants")
+		scopeList := flags.String("scopes", "", "scopes separated by commas: collect, report or admin")
+		_ = flags.Parse(args[1:])
+		if flags.NArg() != 0 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		keyScopes, err := ParseScopes(*scopeList)
+		if err != nil {
+			return err
+		}
+		key, err := stat.CreateAPIKey(*name, *tenant, keyScopes)
+		if err != nil {
+			return err
+		}
+		return encoder.Encode(key)
+	case "list":
+		tenant := flags.String("tenant", "", "only list the keys of this tenant")
+		_ = flags.Parse(args[1:])
+		if flags.NArg() != 0 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		keys, err := stat.APIKeys(*tenant)
+		if err != nil {
+			return err
+		}
+		return encoder.Encode(keys)
+	case "revoke":
+		_ = flags.Parse(args[1:])
+		if flags.NArg() != 1 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		err := stat.RevokeAPIKey(flags.Arg(0), "")
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("no active key %s", flags.Arg(0))
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s revoked\n", flags.Arg(0))
+		return nil
+	}
+	fmt.Fprintln(os.Stderr, usage)
+	os.Exit(2)
+	return nil
+}
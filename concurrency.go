@@ -0,0 +1,277 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultConcurrencyStep = time.Minute
+	minConcurrencyStep     = time.Second
+	maxConcurrencyBuckets  = 100000
+	defaultConcurrencyTop  = 5
+)
+
+type sessionInterval struct {
+	eventId  string
+	viewerId int32
+	join     time.Time
+	leave    time.Time
+}
+
+// eventViewerKey identifies a viewer within an event.
+type eventViewerKey struct {
+	eventId  string
+	viewerId int32
+}
+
+func (session sessionInterval) viewer() eventViewerKey {
+	return eventViewerKey{eventId: session.eventId, viewerId: session.viewerId}
+}
+
+// concurrencySegment is a period during which the number of simultaneous viewers does not change.
+type concurrencySegment struct {
+	start time.Time
+	end   time.Time
+	count int
+}
+
+type ConcurrencyBucket struct {
+	Time    time.Time `json:"time"`
+	Viewers int       `json:"viewers"`
+}
+
+type ConcurrencyPeak struct {
+	StartTime time.Time `json:"startTime"`
+	EndTime   time.Time `json:"endTime"`
+	Viewers   int       `json:"viewers"`
+	Duration  float64   `json:"duration"`
+}
+
+func (stat *Stat) sessionIntervals(filter *reportFilter) ([]sessionInterval, error) {
+	rows, err := stat.conn.Query(`SELECT "eventId", "viewerId", "joinTime", "leaveTime" FROM "stats"`+filter.String(), filter.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			log.Printf("Close failed: %v\n", err)
+		}
+	}(rows)
+
+	var sessions []sessionInterval
+	for rows.Next() {
+		var eventId string
+		var viewerId int32
+		var joinTime, leaveTime sql.NullString
+		err := rows.Scan(&eventId, &viewerId, &joinTime, &leaveTime)
+		if err != nil {
+			return nil, err
+		}
+		join, err := time.Parse(time.RFC3339, joinTime.String)
+		if err != nil {
+			continue
+		}
+		leave, err := time.Parse(time.RFC3339, leaveTime.String)
+		if err != nil || !leave.After(join) {
+			continue
+		}
+		sessions = append(sessions, sessionInterval{eventId: eventId, viewerId: viewerId, join: join, leave: leave})
+	}
+	return sessions, rows.Err()
+}
+
+// mergeIntervals joins overlapping sessions of the same viewer in the same
+// event, so a viewer watching from two devices or reconnecting is counted once.
+// The same viewerId in another event is another viewer.
+func mergeIntervals(sessions []sessionInterval) []sessionInterval {
+	sorted := make([]sessionInterval, len(sessions))
+	copy(sorted, sessions)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].eventId != sorted[j].eventId {
+			return sorted[i].eventId < sorted[j].eventId
+		}
+		if sorted[i].viewerId == sorted[j].viewerId {
+			return sorted[i].join.Before(sorted[j].join)
+		}
+		return sorted[i].viewerId < sorted[j].viewerId
+	})
+
+	var merged []sessionInterval
+	for _, session := range sorted {
+		last := len(merged) - 1
+		if last >= 0 && merged[last].viewer() == session.viewer() && !session.join.After(merged[last].leave) {
+			if session.leave.After(merged[last].leave) {
+				merged[last].leave = session.leave
+			}
+			continue
+		}
+		merged = append(merged, session)
+	}
+	return merged
+}
+
+// concurrencySegments sweeps over joins and leaves and returns the number of
+// simultaneous viewers between every two consecutive changes. A viewer leaving
+// at the moment another one joins is not counted twice.
+func concurrencySegments(sessions []sessionInterval) []concurrencySegment {
+	type change struct {
+		time  time.Time
+		delta int
+	}
+	changes := make([]change, 0, 2*len(sessions))
+	for _, session := range sessions {
+		changes = append(changes, change{session.join, 1}, change{session.leave, -1})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].time.Equal(changes[j].time) {
+			return changes[i].delta < changes[j].delta
+		}
+		return changes[i].time.Before(changes[j].time)
+	})
+
+	var segments []concurrencySegment
+	var count int
+	for i := 0; i < len(changes); {
+		t := changes[i].time
+		for i < len(changes) && changes[i].time.Equal(t) {
+			count += changes[i].delta
+			i++
+		}
+		if i < len(changes) {
+			segments = append(segments, concurrencySegment{start: t, end: changes[i].time, count: count})
+		}
+	}
+	return segments
+}
+
+// concurrencyTimeline returns the largest number of simultaneous viewers within
+// every step. Buckets are aligned to the wall clock of loc.
+func concurrencyTimeline(segments []concurrencySegment, step time.Duration, loc *time.Location) ([]ConcurrencyBucket, error) {
+	if len(segments) == 0 {
+		return []ConcurrencyBucket{}, nil
+	}
+	_, offset := segments[0].start.In(loc).Zone()
+	shift := time.Duration(offset) * time.Second
+	start := segments[0].start.Add(shift).Truncate(step).Add(-shift)
+	end := segments[len(segments)-1].end
+	n := int(end.Sub(start)/step) + 1
+	if n > maxConcurrencyBuckets {
+		return nil, fmt.Errorf("too many buckets: %v", n)
+	}
+
+	buckets := make([]ConcurrencyBucket, n)
+	for i := range buckets {
+		buckets[i].Time = start.Add(time.Duration(i) * step).UTC()
+	}
+	for _, segment := range segments {
+		first := int(segment.start.Sub(start) / step)
+		last := int((segment.end.Sub(start) - 1) / step)
+		for i := first; i <= last; i++ {
+			if segment.count > buckets[i].Viewers {
+				buckets[i].Viewers = segment.count
+			}
+		}
+	}
+	return buckets, nil
+}
+
+// concurrencyPeaks returns the top distinct peaks: periods with more viewers
+// than right before and right after them.
+func concurrencyPeaks(segments []concurrencySegment, top int) []ConcurrencyPeak {
+	// merge neighbours with the same number of viewers into plateaus
+	var plateaus []concurrencySegment
+	for _, segment := range segments {
+		last := len(plateaus) - 1
+		if last >= 0 && plateaus[last].count == segment.count && plateaus[last].end.Equal(segment.start) {
+			plateaus[last].end = segment.end
+			continue
+		}
+		plateaus = append(plateaus, segment)
+	}
+
+	peaks := []ConcurrencyPeak{}
+	for i, plateau := range plateaus {
+		if plateau.count == 0 {
+			continue
+		}
+		if i > 0 && plateaus[i-1].count >= plateau.count {
+			continue
+		}
+		if i < len(plateaus)-1 && plateaus[i+1].count >= plateau.count {
+			continue
+		}
+		peaks = append(peaks, ConcurrencyPeak{
+			StartTime: plateau.start.UTC(),
+			EndTime:   plateau.end.UTC(),
+			Viewers:   plateau.count,
+			Duration:  plateau.end.Sub(plateau.start).Seconds(),
+		})
+	}
+	sort.SliceStable(peaks, func(i, j int) bool {
+		if peaks[i].Viewers == peaks[j].Viewers {
+			return peaks[i].Duration > peaks[j].Duration
+		}
+		return peaks[i].Viewers > peaks[j].Viewers
+	})
+	if len(peaks) > top {
+		peaks = peaks[:top]
+	}
+	return peaks
+}
+
+// parseStep accepts Go durations such as 10s, 1m or 5m.
+func parseStep(s string) (time.Duration, error) {
+	if s == "" {
+		return defaultConcurrencyStep, nil
+	}
+	step, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if step < minConcurrencyStep {
+		return 0, errors.New("step is too small")
+	}
+	return step, nil
+}
+
+func (stat *Stat) concurrencyReport(options ReportOptions, column string, filter *reportFilter) (*Table, error) {
+	sessions, err := stat.sessionIntervals(filter)
+	if err != nil {
+		return nil, err
+	}
+	// viewers watching from two devices or reconnecting are counted once
+	segments := concurrencySegments(mergeIntervals(sessions))
+
+	if column == "concurrencyPeaks" {
+		top, err := strconv.Atoi(options.Default("top", strconv.Itoa(defaultConcurrencyTop)))
+		if err != nil || top < 1 {
+			return nil, fmt.Errorf("%w: incorrect top %q", ErrInvalidReport, options.Get("top"))
+		}
+		table := NewTable(column, "startTime", "endTime", "viewers", "duration")
+		for _, peak := range concurrencyPeaks(segments, top) {
+			table.Append(peak.StartTime, peak.EndTime, peak.Viewers, peak.Duration)
+		}
+		return table, nil
+	}
+
+	step, err := parseStep(options.Get("step"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidReport, err)
+	}
+	timeline, err := concurrencyTimeline(segments, step, filter.loc)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidReport, err)
+	}
+	table := NewTable(column, "time", "viewers")
+	for _, bucket := range timeline {
+		table.Append(bucket.Time, bucket.Viewers)
+	}
+	return table, nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultRetentionInterval = 24 * time.Hour
+
+// Duration reads durations such as "90s" or "24h" from configuration files.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
+// Config is the configuration shared by all commands. It is read from a YAML
+// or TOML file, then from STAT_* environment variables and finally from the
+// command-line flags, each overriding the one before.
+type Config struct {
+	Listen    string          `yaml:"listen" toml:"listen"`
+	Storage   StorageConfig   `yaml:"storage" toml:"storage"`
+	Geo       GeoConfig       `yaml:"geo" toml:"geo"`
+	Auth      AuthConfig      `yaml:"auth" toml:"auth"`
+	Presence  PresenceConfig  `yaml:"presence" toml:"presence"`
+	Rollups   RollupsConfig   `yaml:"rollups" toml:"rollups"`
+	Retention RetentionConfig `yaml:"retention" toml:"retention"`
+	Logging   LoggingConfig   `yaml:"logging" toml:"logging"`
+}
+
+type StorageConfig struct {
+	DSN string `yaml:"dsn" toml:"dsn"`
+}
+
+type GeoConfig struct {
+	Backend     string   `yaml:"backend" toml:"backend"`
+	CityDB      string   `yaml:"cityDB" toml:"cityDB"`
+	ASNDB       string   `yaml:"asnDB" toml:"asnDB"`
+	IPInfoToken string   `yaml:"ipinfoToken" toml:"ipinfoToken"`
+	CacheTTL    Duration `yaml:"cacheTTL" toml:"cacheTTL"`
+	Workers     int      `yaml:"workers" toml:"workers"`
+	Timeout     Duration `yaml:"timeout" toml:"timeout"`
+}
+
+// AuthConfig requires an API key with the right scope on every endpoint but
+// /ping when Required is set. Keys are managed with the keys command.
+type AuthConfig struct {
+	Required bool `yaml:"required" toml:"required"`
+	// SigningKey signs attendance lists.
+	SigningKey string `yaml:"signingKey" toml:"signingKey"`
+}
+
+type PresenceConfig struct {
+	Timeout Duration `yaml:"timeout" toml:"timeout"`
+}
+
+type RollupsConfig struct {
+	Interval Duration `yaml:"interval" toml:"interval"`
+}
+
+// RetentionConfig purges sessions older than MaxAge every Interval while the
+// server runs. A zero MaxAge keeps sessions forever.
+type RetentionConfig struct {
+	MaxAge   Duration `yaml:"maxAge" toml:"maxAge"`
+	Interval Duration `yaml:"interval" toml:"interval"`
+}
+
+// LoggingConfig sends the log to a file, or to the standard error without one,
+// and turns the log line of every request on or off.
+type LoggingConfig struct {
+	Output   string `yaml:"output" toml:"output"`
+	Requests bool   `yaml:"requests" toml:"requests"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Listen:  ":81",
+		Storage: StorageConfig{DSN: defaultDSN},
+		Geo: GeoConfig{
+			Backend:  "ipinfo",
+			CityDB:   "./db/GeoLite2-City.mmdb",
+			CacheTTL: Duration{defaultGeoCacheTTL},
+			Workers:  defaultGeoWorkers,
+			Timeout:  Duration{defaultGeoTimeout},
+		},
+		Auth:      AuthConfig{Required: true},
+		Presence:  PresenceConfig{Timeout: Duration{defaultPresenceTimeout}},
+		Rollups:   RollupsConfig{Interval: Duration{defaultRollupInterval}},
+		Retention: RetentionConfig{Interval: Duration{defaultRetentionInterval}},
+		Logging:   LoggingConfig{Requests: true},
+	}
+}
+
+// Load reads a configuration file over the current values. Keys missing from
+// the file keep their values, unknown keys are an error.
+func (config *Config) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(config)
+		if err == io.EOF {
+			err = nil
+		}
+	case ".toml":
+		decoder := toml.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(config)
+	default:
+		return fmt.Errorf("%s: configuration files are .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// envOverride binds an environment variable to a configuration value.
+type envOverride struct {
+	name  string
+	value interface{}
+}
+
+func (config *Config) envOverrides() []envOverride {
+	return []envOverride{
+		{"STAT_LISTEN", &config.Listen},
+		{"STAT_DSN", &config.Storage.DSN},
+		{"STAT_GEO_BACKEND", &config.Geo.Backend},
+		{"STAT_GEO_CITY_DB", &config.Geo.CityDB},
+		{"STAT_GEO_ASN_DB", &config.Geo.ASNDB},
+		{"STAT_IPINFO_TOKEN", &config.Geo.IPInfoToken},
+		{"STAT_GEO_CACHE_TTL", &config.Geo.CacheTTL},
+		{"STAT_GEO_WORKERS", &config.Geo.Workers},
+		{"STAT_GEO_TIMEOUT", &config.Geo.Timeout},
+		{"STAT_AUTH_REQUIRED", &config.Auth.Required},
+		{"STAT_SIGNING_KEY", &config.Auth.SigningKey},
+		{"STAT_PRESENCE_TIMEOUT", &config.Presence.Timeout},
+		{"STAT_ROLLUP_INTERVAL", &config.Rollups.Interval},
+		{"STAT_RETENTION_MAX_AGE", &config.Retention.MaxAge},
+		{"STAT_RETENTION_INTERVAL", &config.Retention.Interval},
+		{"STAT_LOG_OUTPUT", &config.Logging.Output},
+		{"STAT_LOG_REQUESTS", &config.Logging.Requests},
+	}
+}
+
+// LoadEnv applies the STAT_* environment variables that are set.
+func (config *Config) LoadEnv(lookup func(string) (string, bool)) error {
+	for _, override := range config.envOverrides() {
+		s, ok := lookup(override.name)
+		if !ok {
+			continue
+		}
+		var err error
+		switch value := override.value.(type) {
+		case *string:
+			*value = s
+		case *int:
+			*value, err = strconv.Atoi(s)
+		case *bool:
+			*value, err = strconv.ParseBool(s)
+		case *Duration:
+			err = value.UnmarshalText([]byte(s))
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", override.name, err)
+		}
+	}
+	return nil
+}
+
+// Validate reports every problem of the configuration at once.
+func (config *Config) Validate() error {
+	var problems []string
+	if config.Listen == "" {
+		problems = append(problems, "listen address is empty")
+	}
+	if _, err := dsnScheme(config.Storage.DSN); err != nil {
+		problems = append(problems, err.Error())
+	}
+	switch config.Geo.Backend {
+	case "", "none", "ipinfo":
+	case "maxmind":
+		if config.Geo.CityDB == "" {
+			problems = append(problems, "the maxmind geo backend needs a city database")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown geo backend %q", config.Geo.Backend))
+	}
+	if config.Geo.CacheTTL.Duration < 0 {
+		problems = append(problems, "geo cache TTL is negative")
+	}
+	if config.Geo.Workers < 1 {
+		problems = append(problems, "geo workers must be at least 1")
+	}
+	if config.Geo.Timeout.Duration <= 0 {
+		problems = append(problems, "geo timeout must be positive")
+	}
+	if config.Presence.Timeout.Duration <= 0 {
+		problems = append(problems, "presence timeout must be positive")
+	}
+	if config.Rollups.Interval.Duration <= 0 {
+		problems = append(problems, "rollup interval must be positive")
+	}
+	if config.Retention.MaxAge.Duration < 0 {
+		problems = append(problems, "retention max age is negative")
+	}
+	if config.Retention.MaxAge.Duration > 0 && config.Retention.Interval.Duration <= 0 {
+		problems = append(problems, "retention interval must be positive")
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
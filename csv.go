@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// CSVMapping maps Viewer fields, named as in the JSON accepted by /collect,
+// onto the CSV column headers of an export.
+type CSVMapping map[string]string
+
+var csvFields = []string{
+	"eventId", "viewerId", "name", "lastName", "isChatName", "email", "isChatEmail",
+	"joinTime", "leaveTime", "spentTime", "spentTimeDeltaPercent", "chatCommentsTotal", "chatCommentsDeltaPercent",
+	"userIP", "platform", "browserClient", "screenData_viewPort", "screenData_resolution",
+}
+
+// DefaultCSVMapping expects the headers to be named like the Viewer JSON fields.
+func DefaultCSVMapping() CSVMapping {
+	mapping := CSVMapping{}
+	for _, field := range csvFields {
+		mapping[field] = field
+	}
+	return mapping
+}
+
+// ParseCSVMapping reads "field=header" pairs separated by commas and applies
+// them on top of the default mapping.
+func ParseCSVMapping(s string) (CSVMapping, error) {
+	mapping := DefaultCSVMapping()
+	if s == "" {
+		return mapping, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		split := strings.SplitN(pair, "=", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("incorrect column mapping %q", pair)
+		}
+		err := mapping.Set(strings.TrimSpace(split[0]), strings.TrimSpace(split[1]))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return mapping, nil
+}
+
+func (mapping CSVMapping) Set(field string, header string) error {
+	if _, ok := mapping[field]; !ok {
+		return fmt.Errorf("unknown viewer field %q", field)
+	}
+	mapping[field] = header
+	return nil
+}
+
+type csvSource struct {
+	reader  *csv.Reader
+	columns map[string]int
+	line    int
+}
+
+// NewCSVSource reads the header row and resolves the mapping against it.
+// Fields whose header is absent are left empty.
+func NewCSVSource(r io.Reader, mapping CSVMapping, delimiter rune) (ViewerSource, error) {
+	reader := csv.NewReader(r)
+	reader.Comma = delimiter
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	byHeader := make(map[string]int)
+	for i, name := range header {
+		if i == 0 {
+			// exports made by Excel start with a byte order mark
+			name = strings.TrimPrefix(name, "\uFEFF")
+		}
+		byHeader[strings.TrimSpace(name)] = i
+	}
+	columns := make(map[string]int)
+	for field, name := range mapping {
+		if i, ok := byHeader[name]; ok {
+			columns[field] = i
+		}
+	}
+	if _, ok := columns["viewerId"]; !ok {
+		return nil, errors.New("viewerId column is missing")
+	}
+	return &csvSource{reader: reader, columns: columns, line: 1}, nil
+}
+
+func (source *csvSource) Next() (Viewer, int, error) {
+	record, err := source.reader.Read()
+	if err == io.EOF {
+		return Viewer{}, source.line, io.EOF
+	}
+	source.line++
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return Viewer{}, source.line, &LineError{Line: source.line, Err: err}
+	}
+	if err != nil {
+		return Viewer{}, source.line, err
+	}
+	viewer, err := source.viewer(record)
+	if err != nil {
+		return Viewer{}, source.line, &LineError{Line: source.line, Err: err}
+	}
+	return viewer, source.line, nil
+}
+
+func (source *csvSource) value(record []string, field string) string {
+	i, ok := source.columns[field]
+	if !ok || i >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[i])
+}
+
+// unmarshalString feeds a CSV cell to the JSON parsers of the Viewer types,
+// an empty cell is passed as null.
+func unmarshalString(s string, target json.Unmarshaler) error {
+	data := []byte("null")
+	if s != "" {
+		data, _ = json.Marshal(s)
+	}
+	return target.UnmarshalJSON(data)
+}
+
+func parseCSVInt(s string, bitSize int) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(s, 10, bitSize)
+}
+
+func parseCSVPercent(s string) (uint8, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 8)
+	return uint8(n), err
+}
+
+func parseCSVBool(s string) (bool, error) {
+	if s == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(s)
+}
+
+func (source *csvSource) viewer(record []string) (Viewer, error) {
+	var v Viewer
+	var err error
+	var n int64
+
+	n, err = parseCSVInt(source.value(record, "viewerId"), 32)
+	if err != nil {
+		return v, fmt.Errorf("viewerId: %w", err)
+	}
+	v.ViewerId = int32(n)
+	v.EventId = source.value(record, "eventId")
+	v.Name = source.value(record, "name")
+	v.LastName = source.value(record, "lastName")
+	v.Email = source.value(record, "email")
+	v.JoinTime = source.value(record, "joinTime")
+	v.LeaveTime = source.value(record, "leaveTime")
+	v.UserIP = source.value(record, "userIP")
+
+	v.IsChatName, err = parseCSVBool(source.value(record, "isChatName"))
+	if err != nil {
+		return v, fmt.Errorf("isChatName: %w", err)
+	}
+	v.IsChatEmail, err = parseCSVBool(source.value(record, "isChatEmail"))
+	if err != nil {
+		return v, fmt.Errorf("isChatEmail: %w", err)
+	}
+	v.SpentTime, err = parseCSVInt(source.value(record, "spentTime"), 64)
+	if err != nil {
+		return v, fmt.Errorf("spentTime: %w", err)
+	}
+	n, err = parseCSVInt(source.value(record, "chatCommentsTotal"), 32)
+	if err != nil {
+		return v, fmt.Errorf("chatCommentsTotal: %w", err)
+	}
+	v.ChatCommentsTotal = int32(n)
+	v.SpentTimeDeltaPercent, err = parseCSVPercent(source.value(record, "spentTimeDeltaPercent"))
+	if err != nil {
+		return v, fmt.Errorf("spentTimeDeltaPercent: %w", err)
+	}
+	v.ChatCommentsDeltaPercent, err = parseCSVPercent(source.value(record, "chatCommentsDeltaPercent"))
+	if err != nil {
+		return v, fmt.Errorf("chatCommentsDeltaPercent: %w", err)
+	}
+
+	err = unmarshalString(source.value(record, "platform"), &v.Platform)
+	if err != nil {
+		return v, fmt.Errorf("platform: %w", err)
+	}
+	err = unmarshalString(source.value(record, "browserClient"), &v.BrowserClient)
+	if err != nil {
+		return v, fmt.Errorf("browserClient: %w", err)
+	}
+	if s := source.value(record, "screenData_viewPort"); s != "" {
+		err = unmarshalString(s, &v.ScreenDataViewPort)
+		if err != nil {
+			return v, fmt.Errorf("screenData_viewPort: %w", err)
+		}
+	}
+	if s := source.value(record, "screenData_resolution"); s != "" {
+		err = unmarshalString(s, &v.ScreenDataResolution)
+		if err != nil {
+			return v, fmt.Errorf("screenData_resolution: %w", err)
+		}
+	}
+	return v, nil
+}
+
+func parseDelimiter(s string) (rune, error) {
+	if s == "" {
+		return ',', nil
+	}
+	if s == `\t` || s == "tab" {
+		return '\t', nil
+	}
+	r, size := utf8.DecodeRuneInString(s)
+	if size != len(s) {
+		return 0, fmt.Errorf("incorrect delimiter %q", s)
+	}
+	return r, nil
+}
+
+// CollectCSV imports a CSV export of the streaming platform. The column mapping
+// is taken from map[field]=header query parameters.
+func (stat *Stat) CollectCSV(c *gin.Context) {
+	stat.ingestRequest(c, func(r io.Reader) (ViewerSource, error) {
+		mapping := DefaultCSVMapping()
+		for field, header := range c.QueryMap("map") {
+			err := mapping.Set(field, header)
+			if err != nil {
+				return nil, err
+			}
+		}
+		delimiter, err := parseDelimiter(c.Query("delimiter"))
+		if err != nil {
+			return nil, err
+		}
+		return NewCSVSource(r, mapping, delimiter)
+	})
+}
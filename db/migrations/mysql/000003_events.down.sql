@@ -0,0 +1,3 @@
+DROP INDEX stats_event ON stats;
+ALTER TABLE stats DROP COLUMN `eventId`;
+DROP TABLE IF EXISTS events;
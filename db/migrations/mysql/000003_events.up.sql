@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS events
+(
+    `eventId` character varying(64) PRIMARY KEY,
+    title character varying(256),
+    `scheduledStart` character varying(35),
+    `scheduledEnd` character varying(35)
+) DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+ALTER TABLE stats ADD COLUMN `eventId` character varying(64);
+CREATE INDEX stats_event ON stats (`eventId`);
@@ -0,0 +1,2 @@
+-- MySQL storage was added after sessions were stored in UTC, there is nothing to convert.
+DO 0;
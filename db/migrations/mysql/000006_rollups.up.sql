@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS rollups_hourly
+(
+    `eventId` character varying(64) NOT NULL,
+    `bucket` character varying(35) NOT NULL,
+    `dimension` character varying(32) NOT NULL,
+    `value` character varying(256),
+    `sessions` integer NOT NULL,
+    `viewers` integer NOT NULL
+) DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+CREATE INDEX rollups_hourly_event ON rollups_hourly (`eventId`, `dimension`, `bucket`);
+CREATE TABLE IF NOT EXISTS rollups_daily
+(
+    `eventId` character varying(64) NOT NULL,
+    `bucket` character varying(35) NOT NULL,
+    `dimension` character varying(32) NOT NULL,
+    `value` character varying(256),
+    `sessions` integer NOT NULL,
+    `viewers` integer NOT NULL
+) DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+CREATE INDEX rollups_daily_event ON rollups_daily (`eventId`, `dimension`, `bucket`);
+CREATE TABLE IF NOT EXISTS rollups_pending
+(
+    `eventId` character varying(64) PRIMARY KEY,
+    `since` character varying(35) NOT NULL,
+    `version` integer NOT NULL
+) DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_bin;
+INSERT INTO rollups_pending SELECT `eventId`, min(`joinTime`), 1 FROM stats GROUP BY `eventId`;
@@ -0,0 +1,3 @@
+DROP INDEX events_tenant ON events;
+ALTER TABLE events DROP COLUMN `tenant`;
+DROP TABLE IF EXISTS api_keys;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS events
+(
+    "eventId" character varying(64) PRIMARY KEY,
+    title character varying(256),
+    "scheduledStart" TIMESTAMP WITH TIME ZONE,
+    "scheduledEnd" TIMESTAMP WITH TIME ZONE
+);
+ALTER TABLE stats ADD COLUMN "eventId" character varying(64);
+CREATE INDEX IF NOT EXISTS stats_event ON stats ("eventId");
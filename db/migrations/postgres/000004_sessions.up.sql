@@ -0,0 +1,42 @@
+CREATE TABLE IF NOT EXISTS viewers
+(
+    "viewerId" integer PRIMARY KEY,
+    name character varying(256),
+    "lastName" character varying(256),
+    "isChatName" boolean,
+    email character varying(256),
+    "isChatEmail" boolean
+);
+INSERT INTO viewers SELECT "viewerId", name, "lastName", "isChatName", email, "isChatEmail" FROM stats;
+CREATE TABLE IF NOT EXISTS sessions
+(
+    "eventId" character varying(64) NOT NULL DEFAULT '',
+    "viewerId" integer NOT NULL,
+    "joinTime" TIMESTAMP WITH TIME ZONE NOT NULL,
+    "leaveTime" TIMESTAMP WITH TIME ZONE,
+    "spentTime" bigint,
+    "spentTimeDeltaPercent" smallint,
+    "chatCommentsTotal" integer,
+    "chatCommentsDeltaPercent" smallint,
+    "anotherFields" bytea,
+    "userIP" character varying(15),
+    "userCountry" character varying(64),
+    "userCity" character varying(64),
+    "userRegion" character varying(32),
+    "userProvider" character varying(32),
+    "platformName" character varying(32),
+    "platformVersion" character varying(32),
+    "platformArchitecture" character varying(32),
+    "browserClientName" character varying(32),
+    "browserClientVersion" character varying(32),
+    "screenData_viewPortX" smallint,
+    "screenData_viewPortY" smallint,
+    "screenData_resolutionX" smallint,
+    "screenData_resolutionY" smallint,
+    PRIMARY KEY ("eventId", "viewerId", "joinTime")
+);
+INSERT INTO sessions SELECT COALESCE("eventId", ''), "viewerId", "joinTime", "leaveTime", "spentTime", "spentTimeDeltaPercent", "chatCommentsTotal", "chatCommentsDeltaPercent", "anotherFields", "userIP", "userCountry", "userCity", "userRegion", "userProvider", "platformName", "platformVersion", "platformArchitecture", "browserClientName", "browserClientVersion", "screenData_viewPortX", "screenData_viewPortY", "screenData_resolutionX", "screenData_resolutionY" FROM stats;
+DROP TABLE stats;
+ALTER TABLE sessions RENAME TO stats;
+CREATE INDEX IF NOT EXISTS stats_event ON stats ("eventId");
+CREATE INDEX IF NOT EXISTS stats_viewer ON stats ("viewerId");
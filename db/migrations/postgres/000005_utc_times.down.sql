@@ -0,0 +1 @@
+-- The original offsets are not kept, times stay in UTC.
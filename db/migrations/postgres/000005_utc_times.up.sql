@@ -0,0 +1 @@
+-- TIMESTAMP WITH TIME ZONE values are kept in UTC already.
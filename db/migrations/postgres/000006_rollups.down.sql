@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS rollups_pending;
+DROP TABLE IF EXISTS rollups_daily;
+DROP TABLE IF EXISTS rollups_hourly;
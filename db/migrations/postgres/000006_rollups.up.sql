@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS rollups_hourly
+(
+    "eventId" character varying(64) NOT NULL,
+    "bucket" TIMESTAMP WITH TIME ZONE NOT NULL,
+    "dimension" character varying(32) NOT NULL,
+    "value" character varying(256),
+    "sessions" integer NOT NULL,
+    "viewers" integer NOT NULL
+);
+CREATE INDEX IF NOT EXISTS rollups_hourly_event ON rollups_hourly ("eventId", "dimension", "bucket");
+CREATE TABLE IF NOT EXISTS rollups_daily
+(
+    "eventId" character varying(64) NOT NULL,
+    "bucket" TIMESTAMP WITH TIME ZONE NOT NULL,
+    "dimension" character varying(32) NOT NULL,
+    "value" character varying(256),
+    "sessions" integer NOT NULL,
+    "viewers" integer NOT NULL
+);
+CREATE INDEX IF NOT EXISTS rollups_daily_event ON rollups_daily ("eventId", "dimension", "bucket");
+CREATE TABLE IF NOT EXISTS rollups_pending
+(
+    "eventId" character varying(64) PRIMARY KEY,
+    "since" TIMESTAMP WITH TIME ZONE NOT NULL,
+    "version" integer NOT NULL
+);
+INSERT INTO rollups_pending SELECT "eventId", min("joinTime"), 1 FROM stats GROUP BY "eventId";
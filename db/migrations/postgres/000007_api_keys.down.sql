@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS events_tenant;
+ALTER TABLE events DROP COLUMN "tenant";
+DROP TABLE IF EXISTS api_keys;
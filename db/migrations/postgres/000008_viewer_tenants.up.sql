@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS tenant_viewers
+(
+    "tenant" character varying(64) NOT NULL DEFAULT '',
+    "viewerId" integer NOT NULL,
+    name character varying(256),
+    "lastName" character varying(256),
+    "isChatName" boolean,
+    email character varying(256),
+    "isChatEmail" boolean,
+    PRIMARY KEY ("tenant", "viewerId")
+);
+-- every tenant whose events the viewer attended gets its own copy of the profile
+INSERT INTO tenant_viewers SELECT DISTINCT COALESCE(e."tenant", ''), v."viewerId", v.name, v."lastName", v."isChatName", v.email, v."isChatEmail"
+FROM viewers v JOIN stats s ON s."viewerId" = v."viewerId" LEFT JOIN events e ON e."eventId" = s."eventId";
+INSERT INTO tenant_viewers SELECT '', "viewerId", name, "lastName", "isChatName", email, "isChatEmail" FROM viewers WHERE "viewerId" NOT IN (SELECT "viewerId" FROM stats);
+DROP TABLE viewers;
+ALTER TABLE tenant_viewers RENAME TO viewers;
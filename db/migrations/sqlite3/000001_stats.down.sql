@@ -0,0 +1 @@
+DROP TABLE IF EXISTS stats;
\ No newline at end of file
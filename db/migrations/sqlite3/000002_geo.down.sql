@@ -0,0 +1,2 @@
+ALTER TABLE stats DROP COLUMN "userCity";
+ALTER TABLE stats DROP COLUMN "userCountry";
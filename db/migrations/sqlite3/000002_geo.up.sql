@@ -0,0 +1,2 @@
+ALTER TABLE stats ADD COLUMN "userCountry" character varying(64);
+ALTER TABLE stats ADD COLUMN "userCity" character varying(64);
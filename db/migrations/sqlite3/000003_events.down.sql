@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS stats_event;
+ALTER TABLE stats DROP COLUMN "eventId";
+DROP TABLE IF EXISTS events;
@@ -0,0 +1,40 @@
+CREATE TABLE IF NOT EXISTS profiles
+(
+    "viewerId" integer PRIMARY KEY,
+    name character varying(256),
+    "lastName" character varying(256),
+    "isChatName" boolean,
+    email character varying(256),
+    "isChatEmail" boolean,
+    "joinTime" TIMESTAMP WITH TIME ZONE,
+    "leaveTime" TIMESTAMP WITH TIME ZONE,
+    "spentTime" bigint,
+    "spentTimeDeltaPercent" smallint,
+    "chatCommentsTotal" integer,
+    "chatCommentsDeltaPercent" smallint,
+    "anotherFields" blob,
+    "userIP" character varying(15),
+    "userRegion" character varying(32),
+    "userProvider" character varying(32),
+    "platformName" character varying(32),
+    "platformVersion" character varying(32),
+    "platformArchitecture" character varying(32),
+    "browserClientName" character varying(32),
+    "browserClientVersion" character varying(32),
+    "screenData_viewPortX" smallint,
+    "screenData_viewPortY" smallint,
+    "screenData_resolutionX" smallint,
+    "screenData_resolutionY" smallint,
+    "userCountry" character varying(64),
+    "userCity" character varying(64),
+    "eventId" character varying(64)
+);
+-- only the first session of every viewer fits into the old schema
+INSERT INTO profiles SELECT s."viewerId", v.name, v."lastName", v."isChatName", v.email, v."isChatEmail", s."joinTime", s."leaveTime", s."spentTime", s."spentTimeDeltaPercent", s."chatCommentsTotal", s."chatCommentsDeltaPercent", s."anotherFields", s."userIP", s."userRegion", s."userProvider", s."platformName", s."platformVersion", s."platformArchitecture", s."browserClientName", s."browserClientVersion", s."screenData_viewPortX", s."screenData_viewPortY", s."screenData_resolutionX", s."screenData_resolutionY", s."userCountry", s."userCity", NULLIF(s."eventId", '')
+FROM stats s LEFT JOIN viewers v ON v."viewerId" = s."viewerId"
+WHERE s."joinTime" = (SELECT min(f."joinTime") FROM stats f WHERE f."viewerId" = s."viewerId")
+ON CONFLICT DO NOTHING;
+DROP TABLE stats;
+DROP TABLE viewers;
+ALTER TABLE profiles RENAME TO stats;
+CREATE INDEX IF NOT EXISTS stats_event ON stats ("eventId");
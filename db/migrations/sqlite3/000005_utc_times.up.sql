@@ -0,0 +1 @@
+UPDATE stats SET "joinTime" = COALESCE(strftime('%Y-%m-%dT%H:%M:%SZ', "joinTime"), "joinTime"), "leaveTime" = COALESCE(strftime('%Y-%m-%dT%H:%M:%SZ', "leaveTime"), "leaveTime");
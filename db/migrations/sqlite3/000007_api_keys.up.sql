@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS api_keys
+(
+    "keyId" character varying(32) PRIMARY KEY,
+    "hash" character varying(64) NOT NULL,
+    "name" character varying(256),
+    "tenant" character varying(64) NOT NULL DEFAULT '',
+    "scopes" character varying(256) NOT NULL,
+    "createdAt" TIMESTAMP WITH TIME ZONE NOT NULL,
+    "revokedAt" TIMESTAMP WITH TIME ZONE
+);
+ALTER TABLE events ADD COLUMN "tenant" character varying(64) NOT NULL DEFAULT '';
+-- events known only from their sessions belong to no tenant
+INSERT INTO events("eventId") SELECT DISTINCT s."eventId" FROM stats s LEFT JOIN events e ON e."eventId" = s."eventId" WHERE e."eventId" IS NULL;
+CREATE INDEX IF NOT EXISTS events_tenant ON events ("tenant");
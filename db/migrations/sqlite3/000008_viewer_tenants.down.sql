@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS global_viewers
+(
+    "viewerId" integer PRIMARY KEY,
+    name character varying(256),
+    "lastName" character varying(256),
+    "isChatName" boolean,
+    email character varying(256),
+    "isChatEmail" boolean
+);
+-- the profiles of a viewer collapse into one, the first tenant wins
+INSERT OR IGNORE INTO global_viewers SELECT "viewerId", name, "lastName", "isChatName", email, "isChatEmail" FROM viewers ORDER BY "tenant";
+DROP TABLE viewers;
+ALTER TABLE global_viewers RENAME TO viewers;
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultEngagementBins = 10
+	// defaultHotScore is the score from which a viewer counts as a hot lead.
+	defaultHotScore = 70
+)
+
+// EngagementWeights sets how much watch time, chat activity and presence at
+// key moments contribute to the score. Weights are relative to each other and
+// only the components with data for an event share the score. Trend is the
+// share of the watch and chat components given to how much the viewer's watch
+// time and comments grew lately, as reported by the delta percents.
+type EngagementWeights struct {
+	Watch   float64
+	Chat    float64
+	Moments float64
+	Trend   float64
+}
+
+var defaultEngagementWeights = EngagementWeights{Watch: 0.6, Chat: 0.3, Moments: 0.1, Trend: 0.25}
+
+type EngagementScore struct {
+	EventId      string  `json:"eventId"`
+	ViewerId     int32   `json:"viewerId"`
+	Name         string  `json:"name"`
+	LastName     string  `json:"lastName"`
+	Email        string  `json:"email"`
+	Watched      float64 `json:"watched"`
+	ChatComments int32   `json:"chatComments"`
+	Moments      int     `json:"moments"`
+	Score        float64 `json:"score"`
+}
+
+// EventEngagement sums up the scores of the viewers of one event.
+type EventEngagement struct {
+	EventId string  `json:"eventId"`
+	Viewers int     `json:"viewers"`
+	Mean    float64 `json:"mean"`
+	Median  float64 `json:"median"`
+	Hot     int     `json:"hot"`
+}
+
+type EngagementBin struct {
+	From    float64 `json:"from"`
+	To      float64 `json:"to"`
+	Viewers int     `json:"viewers"`
+}
+
+// eventViewer is a viewer of one event together with all of their sessions.
+type eventViewer struct {
+	EventId      string
+	ViewerId     int32
+	Name         string
+	LastName     string
+	Email        string
+	ChatComments int32
+	// SpentTime is the watch time the platform reported over all sessions.
+	SpentTime time.Duration
+	// the delta percents of the latest session
+	SpentTrend int
+	ChatTrend  int
+	latest     time.Time
+	sessions   []sessionInterval
+}
+
+// eventViewers loads the sessions matching the filter grouped by event and viewer.
+func (stat *Stat) eventViewers(filter *reportFilter) (map[string]map[int32]*eventViewer, error) {
+	sqlStr := `SELECT "eventId", s."viewerId", "joinTime", "leaveTime", COALESCE("spentTime", 0), COALESCE("spentTimeDeltaPercent", 0), COALESCE("chatCommentsTotal", 0), COALESCE("chatCommentsDeltaPercent", 0), COALESCE(v."name", ''), COALESCE(v."lastName", ''), COALESCE(v."email", '') FROM "stats" s` + viewersJoin + filter.String()
+	rows, err := stat.conn.Query(sqlStr, filter.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			log.Printf("Close failed: %v\n", err)
+		}
+	}(rows)
+
+	events := make(map[string]map[int32]*eventViewer)
+	for rows.Next() {
+		var row eventViewer
+		var joinTime, leaveTime sql.NullString
+		var spentTime int64
+		var spentTrend, chatTrend int
+		err := rows.Scan(&row.EventId, &row.ViewerId, &joinTime, &leaveTime, &spentTime, &spentTrend, &row.ChatComments, &chatTrend, &row.Name, &row.LastName, &row.Email)
+		if err != nil {
+			return nil, err
+		}
+		viewers, ok := events[row.EventId]
+		if !ok {
+			viewers = make(map[int32]*eventViewer)
+			events[row.EventId] = viewers
+		}
+		viewer, ok := viewers[row.ViewerId]
+		if !ok {
+			viewer = &row
+			viewers[row.ViewerId] = viewer
+		}
+		// the platform reports the running total of comments with every session
+		if row.ChatComments > viewer.ChatComments {
+			viewer.ChatComments = row.ChatComments
+		}
+		viewer.SpentTime += time.Duration(spentTime)
+		join, joinErr := time.Parse(time.RFC3339, joinTime.String)
+		if joinErr == nil && !join.Before(viewer.latest) {
+			viewer.latest = join
+			viewer.SpentTrend, viewer.ChatTrend = spentTrend, chatTrend
+		}
+		leave, leaveErr := time.Parse(time.RFC3339, leaveTime.String)
+		if joinErr == nil && leaveErr == nil && leave.After(join) {
+			viewer.sessions = append(viewer.sessions, sessionInterval{eventId: row.EventId, viewerId: row.ViewerId, join: join, leave: leave})
+		}
+	}
+	return events, rows.Err()
+}
+
+// eventSpan returns the scheduled duration of the event, or the span of its
+// sessions if the schedule is unknown.
+func (stat *Stat) eventSpan(eventId string, tenant string, sessions []sessionInterval) (time.Time, time.Time) {
+	start, end, err := stat.schedule(eventId, tenant)
+	if err == nil {
+		return start, end
+	} else if err != ErrNoSchedule {
+		log.Printf("eventSpan failed: %v\n", err)
+	}
+
+	for i, session := range sessions {
+		if i == 0 || session.join.Before(start) {
+			start = session.join
+		}
+		if session.leave.After(end) {
+			end = session.leave
+		}
+	}
+	return start, end
+}
+
+// engagementScores scores every viewer of every event matching the filter and
+// returns them ranked from the most engaged one.
+func (stat *Stat) engagementScores(filter *reportFilter, tenant string, weights EngagementWeights, moments []time.Time) ([]EngagementScore, error) {
+	events, err := stat.eventViewers(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	scores := []EngagementScore{}
+	for eventId, viewers := range events {
+		var all []sessionInterval
+		var maxComments int32
+		var maxSpentTrend, maxChatTrend int
+		for _, viewer := range viewers {
+			all = append(all, viewer.sessions...)
+			if viewer.ChatComments > maxComments {
+				maxComments = viewer.ChatComments
+			}
+			if viewer.SpentTrend > maxSpentTrend {
+				maxSpentTrend = viewer.SpentTrend
+			}
+			if viewer.ChatTrend > maxChatTrend {
+				maxChatTrend = viewer.ChatTrend
+			}
+		}
+		start, end := stat.eventSpan(eventId, tenant, all)
+		duration := end.Sub(start).Seconds()
+
+		for _, viewer := range viewers {
+			score := EngagementScore{
+				EventId:      viewer.EventId,
+				ViewerId:     viewer.ViewerId,
+				Name:         viewer.Name,
+				LastName:     viewer.LastName,
+				Email:        viewer.Email,
+				ChatComments: viewer.ChatComments,
+			}
+			var watched time.Duration
+			for _, session := range mergeIntervals(viewer.sessions) {
+				for _, moment := range moments {
+					if !moment.Before(session.join) && moment.Before(session.leave) {
+						score.Moments++
+					}
+				}
+				// only the part of the session within the event counts
+				from, to := session.join, session.leave
+				if from.Before(start) {
+					from = start
+				}
+				if to.After(end) {
+					to = end
+				}
+				if to.After(from) {
+					watched += to.Sub(from)
+				}
+			}
+			// sessions may be missing or cut short, the reported watch time is
+			// used when it is longer
+			if viewer.SpentTime > watched {
+				watched = viewer.SpentTime
+			}
+			score.Watched = watched.Seconds()
+
+			// components without data for the event are left out, so an event
+			// nobody commented in is scored on watch time and moments alone
+			var total, weight float64
+			if duration > 0 {
+				watch := trended(math.Min(1, score.Watched/duration), viewer.SpentTrend, maxSpentTrend, weights.Trend)
+				total += weights.Watch * watch
+				weight += weights.Watch
+			}
+			if maxComments > 0 {
+				chat := trended(float64(score.ChatComments)/float64(maxComments), viewer.ChatTrend, maxChatTrend, weights.Trend)
+				total += weights.Chat * chat
+				weight += weights.Chat
+			}
+			if len(moments) > 0 {
+				total += weights.Moments * float64(score.Moments) / float64(len(moments))
+				weight += weights.Moments
+			}
+			if weight > 0 {
+				score.Score = math.Round(total/weight*10000) / 100
+			}
+			scores = append(scores, score)
+		}
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].Score == scores[j].Score {
+			if scores[i].EventId == scores[j].EventId {
+				return scores[i].ViewerId < scores[j].ViewerId
+			}
+			return scores[i].EventId < scores[j].EventId
+		}
+		return scores[i].Score > scores[j].Score
+	})
+	return scores, nil
+}
+
+// trended blends a component with the viewer's delta percent, relative to the
+// largest one of the event. Events without delta percents keep the component.
+func trended(value float64, trend int, maxTrend int, share float64) float64 {
+	if maxTrend <= 0 {
+		return value
+	}
+	return (1-share)*value + share*float64(trend)/float64(maxTrend)
+}
+
+// eventEngagement sums up the scores per event, counting the viewers scoring
+// at least hot. The events are ordered by eventId.
+func eventEngagement(scores []EngagementScore, hot float64) []EventEngagement {
+	byEvent := make(map[string][]float64)
+	for _, score := range scores {
+		byEvent[score.EventId] = append(byEvent[score.EventId], score.Score)
+	}
+	events := make([]EventEngagement, 0, len(byEvent))
+	for eventId, values := range byEvent {
+		event := EventEngagement{EventId: eventId, Viewers: len(values)}
+		var sum float64
+		for _, value := range values {
+			sum += value
+			if value >= hot {
+				event.Hot++
+			}
+		}
+		sort.Float64s(values)
+		middle := len(values) / 2
+		if len(values)%2 == 0 {
+			event.Median = (values[middle-1] + values[middle]) / 2
+		} else {
+			event.Median = values[middle]
+		}
+		event.Median = math.Round(event.Median*100) / 100
+		event.Mean = math.Round(sum/float64(len(values))*100) / 100
+		events = append(events, event)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].EventId < events[j].EventId
+	})
+	return events
+}
+
+// engagementHistogram splits the 0-100 score range into bins of equal width.
+func engagementHistogram(scores []EngagementScore, bins int) []EngagementBin {
+	histogram := make([]EngagementBin, bins)
+	width := 100 / float64(bins)
+	for i := range histogram {
+		histogram[i].From = math.Round(float64(i)*width*100) / 100
+		histogram[i].To = math.Round(float64(i+1)*width*100) / 100
+	}
+	for _, score := range scores {
+		i := int(score.Score / width)
+		if i >= bins {
+			i = bins - 1
+		}
+		histogram[i].Viewers++
+	}
+	return histogram
+}
+
+func parseWeight(options ReportOptions, name string, value float64) (float64, error) {
+	s := options.Get(name)
+	if s == "" {
+		return value, nil
+	}
+	weight, err := strconv.ParseFloat(s, 64)
+	if err != nil || weight < 0 || math.IsInf(weight, 0) {
+		return 0, fmt.Errorf("incorrect %v %q", name, s)
+	}
+	return weight, nil
+}
+
+// engagementOptions reads watchWeight, chatWeight, momentsWeight, trendWeight
+// and the key moments, given as comma separated RFC3339 times.
+func engagementOptions(options ReportOptions) (EngagementWeights, []time.Time, error) {
+	weights := defaultEngagementWeights
+	var err error
+	weights.Watch, err = parseWeight(options, "watchWeight", weights.Watch)
+	if err != nil {
+		return weights, nil, err
+	}
+	weights.Chat, err = parseWeight(options, "chatWeight", weights.Chat)
+	if err != nil {
+		return weights, nil, err
+	}
+	weights.Moments, err = parseWeight(options, "momentsWeight", weights.Moments)
+	if err != nil {
+		return weights, nil, err
+	}
+	weights.Trend, err = parseWeight(options, "trendWeight", weights.Trend)
+	if err != nil {
+		return weights, nil, err
+	}
+	if weights.Trend > 1 {
+		return weights, nil, fmt.Errorf("incorrect trendWeight %q", options.Get("trendWeight"))
+	}
+
+	var moments []time.Time
+	for _, s := range strings.Split(options.Get("moments"), ",") {
+		if s == "" {
+			continue
+		}
+		moment, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return weights, nil, err
+		}
+		moments = append(moments, moment)
+	}
+	return weights, moments, nil
+}
+
+func (stat *Stat) engagementReport(options ReportOptions, column string, filter *reportFilter) (*Table, error) {
+	weights, moments, err := engagementOptions(options)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidReport, err)
+	}
+	scores, err := stat.engagementScores(filter, options.Tenant, weights, moments)
+	if err != nil {
+		return nil, err
+	}
+
+	if column == "engagementHistogram" {
+		bins, err := strconv.Atoi(options.Default("bins", strconv.Itoa(defaultEngagementBins)))
+		if err != nil || bins < 1 || bins > 100 {
+			return nil, fmt.Errorf("%w: incorrect bins %q", ErrInvalidReport, options.Get("bins"))
+		}
+		table := NewTable(column, "from", "to", "viewers")
+		for _, bin := range engagementHistogram(scores, bins) {
+			table.Append(bin.From, bin.To, bin.Viewers)
+		}
+		return table, nil
+	}
+	if column == "engagementEvents" {
+		hot, err := strconv.ParseFloat(options.Default("hot", strconv.Itoa(defaultHotScore)), 64)
+		if err != nil || hot < 0 || hot > 100 {
+			return nil, fmt.Errorf("%w: incorrect hot %q", ErrInvalidReport, options.Get("hot"))
+		}
+		table := NewTable(column, "eventId", "viewers", "mean", "median", "hot")
+		for _, event := range eventEngagement(scores, hot) {
+			table.Append(event.EventId, event.Viewers, event.Mean, event.Median, event.Hot)
+		}
+		return table, nil
+	}
+
+	table := NewTable(column, "eventId", "viewerId", "name", "lastName", "email", "watched", "chatComments", "moments", "score")
+	for _, score := range scores {
+		table.Append(score.EventId, score.ViewerId, score.Name, score.LastName, score.Email, score.Watched, score.ChatComments, score.Moments, score.Score)
+	}
+	return table, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"github.com/patrickmn/go-cache"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	unknownValue       = "unknown"
+	defaultGeoCacheTTL = 24 * time.Hour
+	defaultGeoWorkers  = 8
+	defaultGeoTimeout  = 2 * time.Second
+)
+
+var ErrResolveTimeout = errors.New("geo lookup timed out")
+
+// Enricher fills the geo fields of collected viewers. Lookups are cached per IP,
+// de-duplicated within a batch and run on a bounded pool of workers.
+type Enricher struct {
+	geo     GeoResolver
+	cache   *cache.Cache
+	workers int
+	timeout time.Duration
+}
+
+func NewEnricher(geo GeoResolver, ttl time.Duration, workers int, timeout time.Duration) *Enricher {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Enricher{geo: geo, cache: cache.New(ttl, 2*ttl), workers: workers, timeout: timeout}
+}
+
+func (enricher *Enricher) Enrich(viewers []Viewer) {
+	results := make(map[string]*GeoInfo)
+	var pending []string
+	for _, v := range viewers {
+		if _, ok := results[v.UserIP]; ok {
+			continue
+		}
+		if cached, ok := enricher.cache.Get(v.UserIP); ok {
+			results[v.UserIP] = cached.(*GeoInfo)
+			continue
+		}
+		results[v.UserIP] = nil
+		pending = append(pending, v.UserIP)
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	ips := make(chan string)
+	workers := enricher.workers
+	if len(pending) < workers {
+		workers = len(pending)
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ip := range ips {
+				info, err := enricher.lookup(ip)
+				if err != nil {
+					log.Printf("Resolve %v failed: %v\n", ip, err)
+					continue
+				}
+				enricher.cache.SetDefault(ip, info)
+				mu.Lock()
+				results[ip] = info
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, ip := range pending {
+		ips <- ip
+	}
+	close(ips)
+	wg.Wait()
+
+	for i := range viewers {
+		info := results[viewers[i].UserIP]
+		if info == nil {
+			info = &GeoInfo{Country: unknownValue, City: unknownValue, Region: unknownValue, Provider: unknownValue}
+		}
+		viewers[i].UserCountry = info.Country
+		viewers[i].UserCity = info.City
+		viewers[i].UserRegion = info.Region
+		viewers[i].UserProvider = info.Provider
+	}
+}
+
+func (enricher *Enricher) lookup(ip string) (*GeoInfo, error) {
+	type result struct {
+		info *GeoInfo
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		info, err := enricher.geo.Resolve(net.ParseIP(ip))
+		done <- result{info, err}
+	}()
+
+	if enricher.timeout <= 0 {
+		r := <-done
+		return r.info, r.err
+	}
+	timer := time.NewTimer(enricher.timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.info, r.err
+	case <-timer.C:
+		return nil, ErrResolveTimeout
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingResolver struct {
+	calls int32
+	delay time.Duration
+}
+
+func (resolver *countingResolver) Resolve(ip net.IP) (*GeoInfo, error) {
+	atomic.AddInt32(&resolver.calls, 1)
+	time.Sleep(resolver.delay)
+	if ip == nil {
+		return nil, ErrInvalidIP
+	}
+	return &GeoInfo{Country: "RU", City: "Moscow", Region: "Moscow", Provider: ip.String()}, nil
+}
+
+func viewersWithIPs(ips ...string) []Viewer {
+	viewers := make([]Viewer, len(ips))
+	for i, ip := range ips {
+		viewers[i].UserIP = ip
+	}
+	return viewers
+}
+
+func TestEnrichDeduplicates(t *testing.T) {
+	geo := &countingResolver{}
+	enricher := NewEnricher(geo, time.Minute, 4, time.Second)
+
+	viewers := viewersWithIPs("10.0.0.1", "10.0.0.2", "10.0.0.1", "10.0.0.1", "10.0.0.2")
+	enricher.Enrich(viewers)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&geo.calls))
+	for _, v := range viewers {
+		assert.Equal(t, v.UserIP, v.UserProvider)
+		assert.Equal(t, "Moscow", v.UserCity)
+	}
+
+	// the second batch is served from the cache
+	enricher.Enrich(viewersWithIPs("10.0.0.1", "10.0.0.2"))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&geo.calls))
+}
+
+func TestEnrichUnknown(t *testing.T) {
+	enricher := NewEnricher(&countingResolver{}, time.Minute, 4, time.Second)
+	viewers := viewersWithIPs("not an ip")
+	enricher.Enrich(viewers)
+	assert.Equal(t, unknownValue, viewers[0].UserRegion)
+	assert.Equal(t, unknownValue, viewers[0].UserProvider)
+}
+
+func TestEnrichTimeout(t *testing.T) {
+	enricher := NewEnricher(&countingResolver{delay: time.Second}, time.Minute, 2, 10*time.Millisecond)
+	viewers := viewersWithIPs("10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4")
+	start := time.Now()
+	enricher.Enrich(viewers)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	for _, v := range viewers {
+		assert.Equal(t, unknownValue, v.UserCountry)
+	}
+}
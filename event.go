@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+)
+
+type Event struct {
+	EventId        string  `json:"eventId"`
+	Title          string  `json:"title"`
+	ScheduledStart *string `json:"scheduledStart"`
+	ScheduledEnd   *string `json:"scheduledEnd"`
+}
+
+// CreateEvent describes an event of the tenant. Events are also created by the
+// first sessions collected for them, describing them later updates them.
+func (stat *Stat) CreateEvent(c *gin.Context) {
+	sqlStr := `UPDATE events SET "title" = $1, "scheduledStart" = $2, "scheduledEnd" = $3 WHERE "eventId" = $4`
+	var event Event
+
+	err := c.BindJSON(&event)
+	if err != nil || event.EventId == "" {
+		log.Printf("CreateEvent failed: %v\n", err)
+		c.JSON(http.StatusBadRequest, gin.H{"result": "failed"})
+		return
+	}
+
+	tx, err := stat.conn.Begin()
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal server error")
+		log.Printf("CreateEvent failed: %v\n", err)
+		return
+	}
+	_, err = stat.claimEvent(tx, event.EventId, tenantOf(c))
+	if err == nil {
+		_, err = tx.Exec(sqlStr, event.Title, event.ScheduledStart, event.ScheduledEnd, event.EventId)
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		_ = tx.Rollback()
+	}
+	if err == ErrForbidden {
+		c.JSON(http.StatusForbidden, gin.H{"result": "forbidden"})
+		return
+	}
+	if err != nil {
+		log.Printf("CreateEvent failed: %v\n", err)
+		c.JSON(http.StatusBadRequest, gin.H{"result": "failed"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"result": "success"})
+}
+
+func (stat *Stat) Events(c *gin.Context) {
+	sqlStr := `SELECT "eventId", COALESCE("title", ''), "scheduledStart", "scheduledEnd" FROM "events"`
+	var args []interface{}
+	if tenant := tenantOf(c); tenant != "" {
+		sqlStr += ` WHERE "tenant" = $1`
+		args = append(args, tenant)
+	}
+	rows, err := stat.conn.Query(sqlStr+` ORDER BY "scheduledStart"`, args...)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal server error")
+		log.Printf("Events failed: %v\n", err)
+		return
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			log.Printf("Close failed: %v\n", err)
+		}
+	}(rows)
+
+	events := []Event{}
+	for rows.Next() {
+		var event Event
+		err := rows.Scan(&event.EventId, &event.Title, &event.ScheduledStart, &event.ScheduledEnd)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Internal server error")
+			log.Printf("Events failed: %v\n", err)
+			return
+		}
+		events = append(events, event)
+	}
+	c.JSON(http.StatusOK, events)
+}
+
+func (stat *Stat) Event(c *gin.Context) {
+	sqlStr := `SELECT "eventId", COALESCE("title", ''), "scheduledStart", "scheduledEnd" FROM "events" WHERE "eventId" = $1`
+	args := []interface{}{c.Param("event")}
+	if tenant := tenantOf(c); tenant != "" {
+		sqlStr += ` AND "tenant" = $2`
+		args = append(args, tenant)
+	}
+	var event Event
+	err := stat.conn.QueryRow(sqlStr, args...).
+		Scan(&event.EventId, &event.Title, &event.ScheduledStart, &event.ScheduledEnd)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"result": "not found"})
+		return
+	}
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal server error")
+		log.Printf("Event failed: %v\n", err)
+		return
+	}
+	c.JSON(http.StatusOK, event)
+}
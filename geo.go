@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ipinfo/go/v2/ipinfo"
+	"github.com/oschwald/geoip2-golang"
+	"net"
+)
+
+type GeoInfo struct {
+	Country  string
+	City     string
+	Region   string
+	Provider string
+}
+
+// GeoResolver looks up the location and network provider of a viewer's IP address.
+type GeoResolver interface {
+	Resolve(ip net.IP) (*GeoInfo, error)
+}
+
+var ErrInvalidIP = errors.New("invalid ip address")
+
+type NopResolver struct{}
+
+func (NopResolver) Resolve(ip net.IP) (*GeoInfo, error) {
+	return &GeoInfo{}, nil
+}
+
+type IPInfoResolver struct {
+	client *ipinfo.Client
+}
+
+func NewIPInfoResolver(token string) *IPInfoResolver {
+	return &IPInfoResolver{client: ipinfo.NewClient(nil, nil, token)}
+}
+
+func (resolver *IPInfoResolver) Resolve(ip net.IP) (*GeoInfo, error) {
+	if ip == nil {
+		return nil, ErrInvalidIP
+	}
+	info, err := resolver.client.GetIPInfo(ip)
+	if err != nil {
+		return nil, err
+	}
+	return &GeoInfo{Country: info.Country, City: info.City, Region: info.Region, Provider: info.Org}, nil
+}
+
+// MaxMindResolver reads a local GeoIP2/GeoLite2 City database and, optionally,
+// an ASN or ISP database for the provider name.
+type MaxMindResolver struct {
+	city *geoip2.Reader
+	asn  *geoip2.Reader
+}
+
+func NewMaxMindResolver(cityPath string, asnPath string) (*MaxMindResolver, error) {
+	city, err := geoip2.Open(cityPath)
+	if err != nil {
+		return nil, err
+	}
+	resolver := &MaxMindResolver{city: city}
+	if asnPath != "" {
+		resolver.asn, err = geoip2.Open(asnPath)
+		if err != nil {
+			_ = city.Close()
+			return nil, err
+		}
+	}
+	return resolver, nil
+}
+
+func (resolver *MaxMindResolver) Resolve(ip net.IP) (*GeoInfo, error) {
+	if ip == nil {
+		return nil, ErrInvalidIP
+	}
+	record, err := resolver.city.City(ip)
+	if err != nil {
+		return nil, err
+	}
+	info := &GeoInfo{
+		Country: record.Country.Names["en"],
+		City:    record.City.Names["en"],
+	}
+	if len(record.Subdivisions) > 0 {
+		info.Region = record.Subdivisions[0].Names["en"]
+	}
+	if resolver.asn != nil {
+		info.Provider, err = resolver.provider(ip)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+func (resolver *MaxMindResolver) provider(ip net.IP) (string, error) {
+	// ISP databases carry a more precise name, ASN databases only the AS organization
+	isp, err := resolver.asn.ISP(ip)
+	if err == nil {
+		if isp.ISP != "" {
+			return isp.ISP, nil
+		}
+		return isp.AutonomousSystemOrganization, nil
+	}
+	asn, err := resolver.asn.ASN(ip)
+	if err != nil {
+		return "", err
+	}
+	return asn.AutonomousSystemOrganization, nil
+}
+
+func (resolver *MaxMindResolver) Close() error {
+	err := resolver.city.Close()
+	if resolver.asn != nil {
+		if asnErr := resolver.asn.Close(); err == nil {
+			err = asnErr
+		}
+	}
+	return err
+}
+
+// NewGeoResolver selects a resolver backend by name: "none", "maxmind" or "ipinfo".
+func NewGeoResolver(backend string, cityPath string, asnPath string, token string) (GeoResolver, error) {
+	switch backend {
+	case "", "none":
+		return NopResolver{}, nil
+	case "maxmind":
+		return NewMaxMindResolver(cityPath, asnPath)
+	case "ipinfo":
+		return NewIPInfoResolver(token), nil
+	default:
+		return nil, fmt.Errorf("unknown geo backend %q", backend)
+	}
+}
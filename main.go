@@ -1,28 +1,159 @@
 package main
 
 import (
-	"database/sql"
-	_ "github.com/mattn/go-sqlite3"
+	"flag"
+	"fmt"
 	"log"
+	"os"
 	"time"
 )
 
+const usage = `usage: pikemedia-stat [flags] [command] [arguments]
+
+Commands:
+  serve     run the HTTP server, the default
+  migrate   manage the database schema
+  import    load JSON, NDJSON or CSV exports of viewers
+  report    run a /report query and print the result
+  purge     delete stored sessions
+  backup    write a backup of the database
+  keys      create, list and revoke API keys
+
+Flags are shared by all commands and come before the command. They override
+the configuration file given by -config or STAT_CONFIG and the STAT_*
+environment variables.
+`
+
 func main() {
-	db, err := sql.Open("sqlite3", "./db/stats.db")
+	config := DefaultConfig()
+	configPath := flag.String("config", os.Getenv("STAT_CONFIG"), "YAML or TOML configuration file")
+	flag.StringVar(&config.Storage.DSN, "dsn", config.Storage.DSN, "database: a SQLite path, a postgres:// URL or mysql:// and a MySQL DSN")
+	flag.StringVar(&config.Listen, "addr", config.Listen, "address the server listens on")
+	flag.StringVar(&config.Geo.Backend, "geo", config.Geo.Backend, "geo backend: none, maxmind or ipinfo")
+	flag.StringVar(&config.Geo.CityDB, "geo-city-db", config.Geo.CityDB, "path to the MaxMind City database")
+	flag.StringVar(&config.Geo.ASNDB, "geo-asn-db", config.Geo.ASNDB, "path to the MaxMind ASN or ISP database")
+	flag.StringVar(&config.Geo.IPInfoToken, "ipinfo-token", config.Geo.IPInfoToken, "ipinfo.io API token")
+	flag.DurationVar(&config.Geo.CacheTTL.Duration, "geo-cache-ttl", config.Geo.CacheTTL.Duration, "how long resolved IPs are cached")
+	flag.IntVar(&config.Geo.Workers, "geo-workers", config.Geo.Workers, "number of concurrent geo lookups per batch")
+	flag.DurationVar(&config.Geo.Timeout.Duration, "geo-timeout", config.Geo.Timeout.Duration, "timeout of a single geo lookup")
+	flag.BoolVar(&config.Auth.Required, "auth-required", config.Auth.Required, "require an API key on every endpoint but /ping")
+	flag.StringVar(&config.Auth.SigningKey, "signing-key", config.Auth.SigningKey, "key signing attendance lists")
+	flag.DurationVar(&config.Presence.Timeout.Duration, "presence-timeout", config.Presence.Timeout.Duration, "how long a viewer stays present after the last heartbeat")
+	flag.DurationVar(&config.Rollups.Interval.Duration, "rollup-interval", config.Rollups.Interval.Duration, "how often report rollups are refreshed")
+	flag.DurationVar(&config.Retention.MaxAge.Duration, "retention-max-age", config.Retention.MaxAge.Duration, "sessions older than this are purged, 0 keeps them")
+	flag.DurationVar(&config.Retention.Interval.Duration, "retention-interval", config.Retention.Interval.Duration, "how often old sessions are purged")
+	flag.StringVar(&config.Logging.Output, "log-output", config.Logging.Output, "file the log is appended to instead of the standard error")
+	flag.BoolVar(&config.Logging.Requests, "log-requests", config.Logging.Requests, "log every request")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage+"\nFlags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// the file and the environment are read over the flags, which are parsed
+	// again so that the command line takes precedence
+	if *configPath != "" {
+		err := config.Load(*configPath)
+		if err != nil {
+			log.Fatalf("FATAL: Error reading configuration: %s\n", err)
+		}
+	}
+	err := config.LoadEnv(os.LookupEnv)
+	if err != nil {
+		log.Fatalf("FATAL: Error reading configuration: %s\n", err)
+	}
+	_ = flag.CommandLine.Parse(os.Args[1:])
+	err = config.Validate()
+	if err != nil {
+		log.Fatalf("FATAL: %s\n", err)
+	}
+
+	if config.Logging.Output != "" {
+		file, err := os.OpenFile(config.Logging.Output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatalf("FATAL: Error opening log: %s\n", err)
+		}
+		log.SetOutput(file)
+	}
+
+	command := "serve"
+	var args []string
+	if flag.NArg() > 0 {
+		command = flag.Arg(0)
+		args = flag.Args()[1:]
+	}
+	switch command {
+	case "serve", "migrate", "import", "report", "purge", "backup", "keys":
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	storage, err := NewStorage(config.Storage.DSN)
 	if err != nil {
 		log.Fatalf("FATAL: Error opening database: %s\n", err)
 	}
 
 	startTime := time.Now()
-	stat := NewStat(db, startTime)
+	stat := NewStat(storage, startTime)
+	stat.SetPresence(NewPresence(config.Presence.Timeout.Duration))
+	stat.SetSigningKey([]byte(config.Auth.SigningKey))
+	stat.SetRequestLogging(config.Logging.Requests)
+	stat.SetAuthRequired(config.Auth.Required)
+
+	// migrate runs before the schema is brought up to date, it may be rolling it back
+	if command == "migrate" {
+		err = migrateCommand(stat, args)
+		if err != nil {
+			log.Fatalf("FATAL: Error migrating database: %s\n", err)
+		}
+		return
+	}
 
 	err = stat.RunMigrations()
 	if err != nil {
 		log.Fatalf("FATAL: Error running migrations: %s\n", err)
 	}
 
-	err = stat.Router().Run(":81")
-	if err != nil {
-		log.Fatalf("FATAL: Error starting server: %s\n", err)
+	// only stored viewers are enriched
+	if command == "serve" || command == "import" {
+		geo, err := NewGeoResolver(config.Geo.Backend, config.Geo.CityDB, config.Geo.ASNDB, config.Geo.IPInfoToken)
+		if err != nil {
+			log.Fatalf("FATAL: Error opening geo database: %s\n", err)
+		}
+		stat.SetEnricher(NewEnricher(geo, config.Geo.CacheTTL.Duration, config.Geo.Workers, config.Geo.Timeout.Duration))
+	}
+
+	switch command {
+	case "serve":
+		err = serveCommand(stat, config)
+		if err != nil {
+			log.Fatalf("FATAL: Error starting server: %s\n", err)
+		}
+	case "import":
+		err = importCommand(stat, args)
+		if err != nil {
+			log.Fatalf("FATAL: Error importing viewers: %s\n", err)
+		}
+	case "report":
+		err = reportCommand(stat, args, os.Stdout)
+		if err != nil {
+			log.Fatalf("FATAL: Error running report: %s\n", err)
+		}
+	case "purge":
+		err = purgeCommand(stat, args)
+		if err != nil {
+			log.Fatalf("FATAL: Error purging sessions: %s\n", err)
+		}
+	case "backup":
+		err = backupCommand(stat, args)
+		if err != nil {
+			log.Fatalf("FATAL: Error backing up database: %s\n", err)
+		}
+	case "keys":
+		err = keysCommand(stat, args, os.Stdout)
+		if err != nil {
+			log.Fatalf("FATAL: Error managing API keys: %s\n", err)
+		}
 	}
 }
@@ -1,18 +1,31 @@
 package main
 
 import (
+	"embed"
 	"github.com/golang-migrate/migrate/v4"
-	"github.com/golang-migrate/migrate/v4/database/sqlite3"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
 )
 
-func (stat *Stat) RunMigrations() error {
-	driver, err := sqlite3.WithInstance(stat.conn, &sqlite3.Config{})
+// migrations are built into the binary, so it runs from any directory.
+//
+//go:embed db/migrations
+var migrations embed.FS
+
+// migrator reads the migrations of the storage dialect from db/migrations.
+func (stat *Stat) migrator() (*migrate.Migrate, error) {
+	source, err := iofs.New(migrations, "db/migrations/"+stat.storage.Name())
 	if err != nil {
-		return err
+		return nil, err
 	}
+	driver, err := stat.storage.MigrationDriver()
+	if err != nil {
+		return nil, err
+	}
+	return migrate.NewWithInstance("iofs", source, stat.storage.Name(), driver)
+}
 
-	m, err := migrate.NewWithDatabaseInstance("file://db/migrations", "sqlite3", driver)
+func (stat *Stat) RunMigrations() error {
+	m, err := stat.migrator()
 	if err != nil {
 		return err
 	}
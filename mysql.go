@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/golang-migrate/migrate/v4/database"
+	migratemysql "github.com/golang-migrate/migrate/v4/database/mysql"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// MySQLStorage keeps the statistics in MySQL or MariaDB. Connections run with
+// ANSI_QUOTES and PIPES_AS_CONCAT, so the double-quoted identifiers and ||
+// of the shared queries keep their meaning, and numbered placeholders are
+// rewritten to the ? MySQL understands.
+//
+// MySQL 5.7 and later and MariaDB 10.3 and later are supported. Upserts refer
+// to the inserted row through a row alias on MySQL 8.0.19 and later, where
+// VALUES() is deprecated, and through VALUES() everywhere else.
+type MySQLStorage struct {
+	db  *sql.DB
+	cfg *mysql.Config
+	// rowAlias is set when the server supports INSERT ... AS alias
+	rowAlias bool
+}
+
+func NewMySQLStorage(dsn string) (*MySQLStorage, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	// migrations run several statements at once
+	cfg.MultiStatements = true
+	if cfg.Params == nil {
+		cfg.Params = make(map[string]string)
+	}
+	cfg.Params["sql_mode"] = "CONCAT(@@sql_mode, ',ANSI_QUOTES,PIPES_AS_CONCAT')"
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	db := sql.OpenDB(rebindConnector{connector})
+	var version string
+	err = db.QueryRow(`SELECT VERSION()`).Scan(&version)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &MySQLStorage{db: db, cfg: cfg, rowAlias: mysqlRowAlias(version)}, nil
+}
+
+// mysqlRowAlias reports whether a server version supports row aliases in
+// INSERT, which MySQL added in 8.0.19 and MariaDB does not have.
+func mysqlRowAlias(version string) bool {
+	if strings.Contains(version, "MariaDB") {
+		return false
+	}
+	var major, minor, patch int
+	_, err := fmt.Sscanf(version, "%d.%d.%d", &major, &minor, &patch)
+	if err != nil {
+		return false
+	}
+	if major != 8 {
+		return major > 8
+	}
+	return minor > 0 || patch >= 19
+}
+
+func (storage *MySQLStorage) Name() string {
+	return "mysql"
+}
+
+func (storage *MySQLStorage) DB() *sql.DB {
+	return storage.db
+}
+
+func (storage *MySQLStorage) MigrationDriver() (database.Driver, error) {
+	return migratemysql.WithInstance(storage.db, &migratemysql.Config{})
+}
+
+func (storage *MySQLStorage) Position(str string, substr string) string {
+	return "instr(" + str + ", " + substr + ")"
+}
+
+func (storage *MySQLStorage) OnConflict(columns ...string) string {
+	if storage.rowAlias {
+		return `AS "excluded" ON DUPLICATE KEY UPDATE`
+	}
+	return `ON DUPLICATE KEY UPDATE`
+}
+
+func (storage *MySQLStorage) Excluded(column string) string {
+	if storage.rowAlias {
+		return `"excluded"."` + column + `"`
+	}
+	return `VALUES("` + column + `")`
+}
+
+// Backup runs mysqldump, which has to be installed, and writes an SQL dump.
+func (storage *MySQLStorage) Backup(path string) error {
+	args := []string{"--single-transaction", "--result-file=" + path, "--user=" + storage.cfg.User}
+	if storage.cfg.Net == "unix" {
+		args = append(args, "--socket="+storage.cfg.Addr)
+	} else {
+		host, port, err := net.SplitHostPort(storage.cfg.Addr)
+		if err != nil {
+			return err
+		}
+		args = append(args, "--host="+host, "--port="+port)
+	}
+	cmd := exec.Command("mysqldump", append(args, storage.cfg.DBName)...)
+	// the password is kept off the command line
+	cmd.Env = append(os.Environ(), "MYSQL_PWD="+storage.cfg.Passwd)
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// rebind replaces the numbered placeholders of a query by ?. MySQL binds
+// arguments in the order of the placeholders, so order lists the argument each
+// ? takes; it is nil when the query has no numbered placeholders. Quoted
+// strings and identifiers are left alone.
+func rebind(query string) (string, []int) {
+	var buf strings.Builder
+	var order []int
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		ch := query[i]
+		switch {
+		case quote != 0:
+			if ch == '\\' && quote == '\'' && i+1 < len(query) {
+				buf.WriteByte(ch)
+				i++
+				ch = query[i]
+			} else if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"' || ch == '`':
+			quote = ch
+		case ch == '$':
+			j := i + 1
+			for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+				j++
+			}
+			if j > i+1 {
+				n, _ := strconv.Atoi(query[i+1 : j])
+				order = append(order, n-1)
+				buf.WriteByte('?')
+				i = j - 1
+				continue
+			}
+		}
+		buf.WriteByte(ch)
+	}
+	if order == nil {
+		return query, nil
+	}
+	return buf.String(), order
+}
+
+// rebindArgs arranges the arguments of a query in the order of its placeholders.
+func rebindArgs(args []driver.NamedValue, order []int) ([]driver.NamedValue, error) {
+	if order == nil {
+		return args, nil
+	}
+	rebound := make([]driver.NamedValue, len(order))
+	for i, n := range order {
+		if n < 0 || n >= len(args) {
+			return nil, fmt.Errorf("no argument for placeholder $%d", n+1)
+		}
+		rebound[i] = driver.NamedValue{Ordinal: i + 1, Value: args[n].Value}
+	}
+	return rebound, nil
+}
+
+// rebindConnector opens connections that rebind the queries they run.
+type rebindConnector struct {
+	driver.Connector
+}
+
+func (connector rebindConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := connector.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &rebindConn{conn: conn}, nil
+}
+
+// rebindConn passes everything to the MySQL connection, rebinding queries on
+// the way. The MySQL connection implements the optional driver interfaces.
+type rebindConn struct {
+	conn driver.Conn
+}
+
+func (c *rebindConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *rebindConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	query, order := rebind(query)
+	stmt, err := c.conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &rebindStmt{stmt: stmt, order: order}, nil
+}
+
+func (c *rebindConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *rebindConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *rebindConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c *rebindConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	query, order := rebind(query)
+	args, err := rebindArgs(args, order)
+	if err != nil {
+		return nil, err
+	}
+	return c.conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+func (c *rebindConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	query, order := rebind(query)
+	args, err := rebindArgs(args, order)
+	if err != nil {
+		return nil, err
+	}
+	return c.conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+}
+
+func (c *rebindConn) Ping(ctx context.Context) error {
+	return c.conn.(driver.Pinger).Ping(ctx)
+}
+
+func (c *rebindConn) CheckNamedValue(nv *driver.NamedValue) error {
+	return c.conn.(driver.NamedValueChecker).CheckNamedValue(nv)
+}
+
+func (c *rebindConn) ResetSession(ctx context.Context) error {
+	return c.conn.(driver.SessionResetter).ResetSession(ctx)
+}
+
+func (c *rebindConn) IsValid() bool {
+	return c.conn.(driver.Validator).IsValid()
+}
+
+// rebindStmt binds the arguments of a prepared statement in placeholder order.
+type rebindStmt struct {
+	stmt  driver.Stmt
+	order []int
+}
+
+func (s *rebindStmt) Close() error {
+	return s.stmt.Close()
+}
+
+// NumInput is not checked, a numbered placeholder may be used more than once.
+func (s *rebindStmt) NumInput() int {
+	return -1
+}
+
+func (s *rebindStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s *rebindStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s *rebindStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	args, err := rebindArgs(args, s.order)
+	if err != nil {
+		return nil, err
+	}
+	return s.stmt.(driver.StmtExecContext).ExecContext(ctx, args)
+}
+
+func (s *rebindStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	args, err := rebindArgs(args, s.order)
+	if err != nil {
+		return nil, err
+	}
+	return s.stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return named
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPresenceTimeout = 30 * time.Second
+	defaultLiveInterval    = 5 * time.Second
+	minLiveInterval        = 100 * time.Millisecond
+)
+
+type Heartbeat struct {
+	EventId  string `json:"eventId"`
+	ViewerId int32  `json:"viewerId"`
+}
+
+type presence struct {
+	joinTime time.Time
+	lastSeen time.Time
+	userIP   string
+}
+
+// LiveMetrics is a snapshot of the audience of an event. Joins and leaves are
+// counted since the event last had neither viewers nor an open live stream.
+type LiveMetrics struct {
+	EventId  string     `json:"eventId"`
+	Time     time.Time  `json:"time"`
+	Viewers  int        `json:"viewers"`
+	Joins    int        `json:"joins"`
+	Leaves   int        `json:"leaves"`
+	Peak     int        `json:"peak"`
+	PeakTime *time.Time `json:"peakTime"`
+}
+
+// Presence tracks the viewers who are watching right now. A viewer is present
+// from the first heartbeat until no heartbeat arrived for the timeout.
+type Presence struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	events  map[string]map[int32]*presence
+	metrics map[string]*LiveMetrics
+	streams map[string]int
+}
+
+func NewPresence(timeout time.Duration) *Presence {
+	return &Presence{timeout: timeout, events: make(map[string]map[int32]*presence), metrics: make(map[string]*LiveMetrics), streams: make(map[string]int)}
+}
+
+func (p *Presence) eventMetrics(eventId string) *LiveMetrics {
+	metrics, ok := p.metrics[eventId]
+	if !ok {
+		metrics = &LiveMetrics{EventId: eventId}
+		p.metrics[eventId] = metrics
+	}
+	return metrics
+}
+
+// prune forgets the metrics of an event without viewers and open streams.
+func (p *Presence) prune(eventId string) {
+	if len(p.events[eventId]) == 0 && p.streams[eventId] == 0 {
+		delete(p.events, eventId)
+		delete(p.metrics, eventId)
+		delete(p.streams, eventId)
+	}
+}
+
+// Watch keeps the metrics of an event while a live stream is open. The
+// returned function closes the stream.
+func (p *Presence) Watch(eventId string) func() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.streams[eventId]++
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.streams[eventId]--
+		p.prune(eventId)
+	}
+}
+
+// Beat registers a heartbeat and reports whether the viewer has just joined.
+func (p *Presence) Beat(heartbeat Heartbeat, userIP string, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	viewers, ok := p.events[heartbeat.EventId]
+	if !ok {
+		viewers = make(map[int32]*presence)
+		p.events[heartbeat.EventId] = viewers
+	}
+	current, ok := viewers[heartbeat.ViewerId]
+	if ok {
+		current.lastSeen = now
+		current.userIP = userIP
+		return false
+	}
+	viewers[heartbeat.ViewerId] = &presence{joinTime: now, lastSeen: now, userIP: userIP}
+
+	metrics := p.eventMetrics(heartbeat.EventId)
+	metrics.Joins++
+	if len(viewers) > metrics.Peak {
+		// the same running peak countPeaks finds in the stored sessions
+		metrics.Peak = len(viewers)
+		peakTime := now
+		metrics.PeakTime = &peakTime
+	}
+	return true
+}
+
+// Expire removes the viewers silent for longer than the timeout and returns
+// their sessions, ending at the last heartbeat.
+func (p *Presence) Expire(now time.Time) []Viewer {
+	return p.expire(func(current *presence) bool {
+		return now.Sub(current.lastSeen) > p.timeout
+	})
+}
+
+// ExpireAll removes every viewer and returns their sessions, ending at the last
+// heartbeat.
+func (p *Presence) ExpireAll() []Viewer {
+	return p.expire(func(*presence) bool {
+		return true
+	})
+}
+
+func (p *Presence) expire(ended func(current *presence) bool) []Viewer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var sessions []Viewer
+	for eventId, viewers := range p.events {
+		for viewerId, current := range viewers {
+			if !ended(current) {
+				continue
+			}
+			sessions = append(sessions, current.viewer(eventId, viewerId))
+			delete(viewers, viewerId)
+			p.eventMetrics(eventId).Leaves++
+		}
+		p.prune(eventId)
+	}
+	return sessions
+}
+
+func (p *Presence) Count(eventId string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.events[eventId])
+}
+
+func (p *Presence) Metrics(eventId string, now time.Time) LiveMetrics {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	metrics := LiveMetrics{EventId: eventId}
+	if stored, ok := p.metrics[eventId]; ok {
+		metrics = *stored
+	}
+	metrics.Time = now
+	metrics.Viewers = len(p.events[eventId])
+	return metrics
+}
+
+func (current *presence) viewer(eventId string, viewerId int32) Viewer {
+	var v Viewer
+	v.EventId = eventId
+	v.ViewerId = viewerId
+	v.JoinTime = current.joinTime.Format(time.RFC3339)
+	v.LeaveTime = current.lastSeen.Format(time.RFC3339)
+	v.SpentTime = int64(current.lastSeen.Sub(current.joinTime))
+	v.UserIP = current.userIP
+	return v
+}
+
+// materialise stores the sessions of the viewers whose presence has ended.
+func (stat *Stat) materialise(now time.Time) {
+	stat.storeEnded(stat.presence.Expire(now))
+}
+
+// FlushPresence ends and stores the sessions of every viewer still present, so
+// they survive a shutdown.
+func (stat *Stat) FlushPresence() {
+	stat.storeEnded(stat.presence.ExpireAll())
+}
+
+func (stat *Stat) storeEnded(ended []Viewer) {
+	if len(ended) == 0 {
+		return
+	}
+	stat.enricher.Enrich(ended)
+	result, err := stat.StoreViewers(ended, CollectOptions{Mode: CollectPartial, Conflict: ConflictMerge})
+	if err != nil {
+		log.Printf("Materialise failed: %v\n", err)
+		return
+	}
+	if failed := result.Failed(); failed > 0 {
+		log.Printf("Materialise failed for %v of %v sessions\n", failed, len(ended))
+	}
+}
+
+// WatchPresence periodically expires silent viewers until stop is closed.
+func (stat *Stat) WatchPresence(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			stat.materialise(now)
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (stat *Stat) Heartbeat(c *gin.Context) {
+	var heartbeat Heartbeat
+	err := c.BindJSON(&heartbeat)
+	if err != nil || heartbeat.EventId == "" {
+		log.Printf("Heartbeat failed: %v\n", err)
+		c.JSON(http.StatusBadRequest, gin.H{"result": "failed"})
+		return
+	}
+	if tenant := tenantOf(c); tenant != "" {
+		_, err = stat.claimEvent(stat.conn, heartbeat.EventId, tenant)
+		if err == ErrForbidden {
+			c.JSON(http.StatusForbidden, gin.H{"result": "forbidden"})
+			return
+		}
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Internal server error")
+			log.Printf("Heartbeat failed: %v\n", err)
+			return
+		}
+	}
+	stat.presence.Beat(heartbeat, c.ClientIP(), time.Now())
+	c.JSON(http.StatusOK, gin.H{"result": "success"})
+}
+
+// liveEvent answers with not found unless the tenant may read the event.
+func (stat *Stat) liveEvent(c *gin.Context) bool {
+	owns, err := stat.ownsEvent(c.Param("event"), tenantOf(c))
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal server error")
+		log.Printf("Live failed: %v\n", err)
+		return false
+	}
+	if !owns {
+		c.JSON(http.StatusNotFound, gin.H{"result": "not found"})
+		return false
+	}
+	return true
+}
+
+func (stat *Stat) Live(c *gin.Context) {
+	if !stat.liveEvent(c) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"eventId": c.Param("event"), "viewers": stat.presence.Count(c.Param("event"))})
+}
+
+// LiveStream pushes the live metrics of an event as Server-Sent Events every interval.
+// Joins and leaves of every message are counted since the previous one.
+func (stat *Stat) LiveStream(c *gin.Context) {
+	if !stat.liveEvent(c) {
+		return
+	}
+	interval, err := time.ParseDuration(c.DefaultQuery("interval", defaultLiveInterval.String()))
+	if err != nil || interval < minLiveInterval {
+		c.String(http.StatusBadRequest, "failed")
+		return
+	}
+
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("Connection", "keep-alive")
+	c.Writer.Header().Set("X-Accel-Buffering", "no")
+	defer stat.presence.Watch(c.Param("event"))()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var previous LiveMetrics
+	now := time.Now()
+	for {
+		metrics := stat.presence.Metrics(c.Param("event"), now)
+		message := metrics
+		message.Joins -= previous.Joins
+		message.Leaves -= previous.Leaves
+		previous = metrics
+		c.SSEvent("metrics", message)
+		c.Writer.Flush()
+
+		select {
+		case now = <-ticker.C:
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// Purge deletes the sessions of an event, the sessions that joined before a
+// time or, given both, the sessions of the event that joined before it. A zero
+// before or an empty eventId does not restrict. Viewers left without sessions
+// are deleted too and the rollups of the affected events are marked stale.
+func (stat *Stat) Purge(eventId string, before time.Time) (int64, error) {
+	filter := &reportFilter{loc: time.UTC}
+	if eventId != "" {
+		filter.where(`"eventId" = ?`, eventId)
+	}
+	if !before.IsZero() {
+		filter.where(`"joinTime" < ?`, storedTime(before))
+	}
+
+	tx, err := stat.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	rows, err := tx.Query(`SELECT "eventId", min("joinTime") FROM "stats"`+filter.String()+` GROUP BY "eventId"`, filter.args...)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	since := make(map[string]string)
+	for rows.Next() {
+		var event string
+		var joinTime sql.NullString
+		err := rows.Scan(&event, &joinTime)
+		if err != nil {
+			_ = rows.Close()
+			_ = tx.Rollback()
+			return 0, err
+		}
+		since[event] = joinTime.String
+	}
+	err = rows.Close()
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	result, err := tx.Exec(`DELETE FROM "stats"`+filter.String(), filter.args...)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	purged, err := result.RowsAffected()
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	_, err = tx.Exec(`DELETE FROM "viewers" WHERE NOT EXISTS (SELECT 1 FROM "stats" s JOIN "events" e ON e."eventId" = s."eventId" WHERE s."viewerId" = "viewers"."viewerId" AND e."tenant" = "viewers"."tenant")`)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	for event, joinTime := range since {
+		err = stat.markRollup(tx, event, joinTime)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+	}
+	return purged, tx.Commit()
+}
+
+// WatchRetention purges the sessions older than maxAge every interval until stop is closed.
+func (stat *Stat) WatchRetention(maxAge time.Duration, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			purged, err := stat.Purge("", time.Now().Add(-maxAge))
+			if err != nil {
+				log.Printf("Retention failed: %v\n", err)
+			} else if purged > 0 {
+				log.Printf("Retention purged %d sessions\n", purged)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultQueryLimit = 1000
+	maxQueryLimit     = 100000
+)
+
+// queryDimensions are the only columns a query can group or filter by.
+var queryDimensions = map[string]string{
+	"event":                `s."eventId"`,
+	"platformName":         `COALESCE(s."platformName", 'unknown')`,
+	"platformVersion":      `COALESCE(s."platformVersion", 'unknown')`,
+	"architecture":         `COALESCE(s."platformArchitecture", 'unknown')`,
+	"browserClientName":    `COALESCE(s."browserClientName", 'unknown')`,
+	"browserClientVersion": `COALESCE(s."browserClientVersion", 'unknown')`,
+	"userCountry":          `COALESCE(s."userCountry", 'unknown')`,
+	"userCity":             `COALESCE(s."userCity", 'unknown')`,
+	"userRegion":           `COALESCE(s."userRegion", 'unknown')`,
+	"userProvider":         `COALESCE(s."userProvider", 'unknown')`,
+	"resolution":           `COALESCE(s."screenData_resolutionX" || 'x' || s."screenData_resolutionY", 'unknown')`,
+	"emailDomain":          "",
+}
+
+// dimensionExpression returns the SQL of a query dimension. The email domain is
+// cut at a position only the storage knows how to find.
+func dimensionExpression(storage Storage, dimension string) string {
+	if dimension == "emailDomain" {
+		return `COALESCE(lower(substr(v."email", ` + storage.Position(`v."email"`, `'@'`) + ` + 1)), 'unknown')`
+	}
+	return queryDimensions[dimension]
+}
+
+// queryMetrics are computed by the database. Spent time is reported in seconds.
+var queryMetrics = map[string]string{
+	"count":           `count(*)`,
+	"uniqueViewers":   `count(DISTINCT s."viewerId")`,
+	"avgSpentTime":    `avg(s."spentTime") / 1e9`,
+	"sumChatComments": `COALESCE(sum(s."chatCommentsTotal"), 0)`,
+}
+
+// queryPercentiles are computed from the spent times of every group.
+var queryPercentiles = map[string]float64{
+	"medianSpentTime": 50,
+	"p95SpentTime":    95,
+}
+
+type Query struct {
+	Dimensions []string
+	Metrics    []string
+	Filters    map[string]string
+	Limit      int
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// ParseQuery reads dimensions, metrics, filter[dimension]=value and limit.
+func ParseQuery(options ReportOptions) (*Query, error) {
+	query := &Query{
+		Dimensions: splitList(options.Get("dimensions")),
+		Metrics:    splitList(options.Default("metrics", "count")),
+		Filters:    options.Map("filter"),
+		Limit:      defaultQueryLimit,
+	}
+	if len(query.Dimensions) == 0 {
+		return nil, errors.New("no dimensions")
+	}
+	for _, dimension := range query.Dimensions {
+		if _, ok := queryDimensions[dimension]; !ok {
+			return nil, fmt.Errorf("unknown dimension %q", dimension)
+		}
+	}
+	for dimension := range query.Filters {
+		if _, ok := queryDimensions[dimension]; !ok {
+			return nil, fmt.Errorf("unknown filter %q", dimension)
+		}
+	}
+	for _, metric := range query.Metrics {
+		_, ok := queryMetrics[metric]
+		_, percentile := queryPercentiles[metric]
+		if !ok && !percentile {
+			return nil, fmt.Errorf("unknown metric %q", metric)
+		}
+	}
+	if s := options.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxQueryLimit {
+			return nil, fmt.Errorf("incorrect limit %q", s)
+		}
+		query.Limit = limit
+	}
+	return query, nil
+}
+
+func (query *Query) where(storage Storage, filter *reportFilter) {
+	dimensions := make([]string, 0, len(query.Filters))
+	for dimension := range query.Filters {
+		dimensions = append(dimensions, dimension)
+	}
+	sort.Strings(dimensions)
+	for _, dimension := range dimensions {
+		filter.where(dimensionExpression(storage, dimension)+` = ?`, query.Filters[dimension])
+	}
+}
+
+func (query *Query) groupBy(storage Storage) string {
+	columns := make([]string, len(query.Dimensions))
+	for i, dimension := range query.Dimensions {
+		columns[i] = dimensionExpression(storage, dimension)
+	}
+	return strings.Join(columns, ", ")
+}
+
+// percentile returns the nearest-rank percentile of sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+// spentTimes returns the sorted spent times, in seconds, of every group.
+func (stat *Stat) spentTimes(query *Query, filter *reportFilter) (map[string][]float64, error) {
+	groupBy := query.groupBy(stat.storage)
+	sqlStr := `SELECT ` + groupBy + `, s."spentTime" / 1e9 FROM "stats" s` + viewersJoin + filter.String() + ` ORDER BY ` + groupBy + `, s."spentTime"`
+	rows, err := stat.conn.Query(sqlStr, filter.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			log.Printf("Close failed: %v\n", err)
+		}
+	}(rows)
+
+	groups := make(map[string][]float64)
+	keys := make([]string, len(query.Dimensions))
+	dest := make([]interface{}, len(query.Dimensions)+1)
+	for i := range keys {
+		dest[i] = &keys[i]
+	}
+	var spentTime sql.NullFloat64
+	dest[len(keys)] = &spentTime
+	for rows.Next() {
+		err := rows.Scan(dest...)
+		if err != nil {
+			return nil, err
+		}
+		if spentTime.Valid {
+			key := strings.Join(keys, "\x00")
+			groups[key] = append(groups[key], spentTime.Float64)
+		}
+	}
+	return groups, rows.Err()
+}
+
+// RunQuery compiles the query to parameterised SQL. Dimensions and metrics are
+// only taken from the whitelists, filter values are always passed as arguments.
+func (stat *Stat) RunQuery(query *Query, filter *reportFilter) (*Table, error) {
+	query.where(stat.storage, filter)
+	groupBy := query.groupBy(stat.storage)
+	selectColumns := groupBy
+
+	var metrics []string
+	var percentiles bool
+	for _, metric := range query.Metrics {
+		if expression, ok := queryMetrics[metric]; ok {
+			metrics = append(metrics, expression)
+		} else {
+			percentiles = true
+		}
+	}
+	if len(metrics) > 0 {
+		selectColumns += ", " + strings.Join(metrics, ", ")
+	}
+	sqlStr := `SELECT ` + selectColumns + ` FROM "stats" s` + viewersJoin + filter.String() +
+		` GROUP BY ` + groupBy + ` ORDER BY count(*) DESC, ` + groupBy + ` LIMIT ` + strconv.Itoa(query.Limit)
+	rows, err := stat.conn.Query(sqlStr, filter.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			log.Printf("Close failed: %v\n", err)
+		}
+	}(rows)
+
+	var groups map[string][]float64
+	if percentiles {
+		groups, err = stat.spentTimes(query, filter)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := NewTable("query", append(append([]string{}, query.Dimensions...), query.Metrics...)...)
+	for rows.Next() {
+		keys := make([]string, len(query.Dimensions))
+		values := make([]sql.NullFloat64, len(metrics))
+		dest := make([]interface{}, 0, len(keys)+len(values))
+		for i := range keys {
+			dest = append(dest, &keys[i])
+		}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		err := rows.Scan(dest...)
+		if err != nil {
+			return nil, err
+		}
+
+		row := make([]interface{}, 0, len(result.Columns))
+		for _, key := range keys {
+			row = append(row, key)
+		}
+		var next int
+		for _, metric := range query.Metrics {
+			if p, ok := queryPercentiles[metric]; ok {
+				row = append(row, percentile(groups[strings.Join(keys, "\x00")], p))
+				continue
+			}
+			value := values[next]
+			next++
+			if metric == "count" || metric == "uniqueViewers" || metric == "sumChatComments" {
+				row = append(row, int64(value.Float64))
+			} else if value.Valid {
+				row = append(row, value.Float64)
+			} else {
+				row = append(row, nil)
+			}
+		}
+		result.Rows = append(result.Rows, row)
+	}
+	return result, rows.Err()
+}
+
+func (stat *Stat) queryReport(options ReportOptions, filter *reportFilter) (*Table, error) {
+	query, err := ParseQuery(options)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidReport, err)
+	}
+	return stat.RunQuery(query, filter)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Table is the result of a report independent of the format it is rendered in.
+// Values are kept typed so that renderers can tell numbers, times and text apart.
+type Table struct {
+	Name    string
+	Columns []string
+	Rows    [][]interface{}
+}
+
+func NewTable(name string, columns ...string) *Table {
+	return &Table{Name: name, Columns: columns, Rows: [][]interface{}{}}
+}
+
+func (table *Table) Append(values ...interface{}) {
+	table.Rows = append(table.Rows, values)
+}
+
+// In converts the times of the table to loc.
+func (table *Table) In(loc *time.Location) {
+	for _, row := range table.Rows {
+		for i, value := range row {
+			if t, ok := value.(time.Time); ok {
+				row[i] = t.In(loc)
+			}
+		}
+	}
+}
+
+// Renderer writes a table in one output format.
+type Renderer interface {
+	ContentType() string
+	Render(w io.Writer, table *Table) error
+}
+
+type CSVRenderer struct{}
+
+type JSONRenderer struct{}
+
+type NDJSONRenderer struct{}
+
+// renderers maps the values of the format query parameter to renderers.
+var renderers = map[string]Renderer{
+	"csv":    CSVRenderer{},
+	"json":   JSONRenderer{},
+	"ndjson": NDJSONRenderer{},
+	"xlsx":   XLSXRenderer{},
+}
+
+// mediaTypes maps the media types of the Accept header to formats.
+var mediaTypes = map[string]string{
+	"text/csv":             "csv",
+	"application/json":     "json",
+	"application/x-ndjson": "ndjson",
+	"application/ndjson":   "ndjson",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": "xlsx",
+}
+
+// mediaTypeOrder is the preference among the media types a wildcard matches.
+var mediaTypeOrder = []string{"text/csv", "application/json", "application/x-ndjson", "application/ndjson", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"}
+
+// ErrNotAcceptable is returned when the Accept header refuses every format.
+var ErrNotAcceptable = errors.New("no acceptable format")
+
+// acceptRange is a media range of the Accept header with its quality.
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept reads the media ranges of an Accept header ordered by quality,
+// listed types before wildcards of the same quality. Ranges that are equal in
+// both keep their order. Malformed ranges are skipped.
+func parseAccept(header string) []acceptRange {
+	var ranges []acceptRange
+	for _, accept := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(s, 64)
+			if err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		ranges = append(ranges, acceptRange{mediaType: mediaType, q: q})
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		if ranges[i].q == ranges[j].q {
+			return ranges[i].specificity() > ranges[j].specificity()
+		}
+		return ranges[i].q > ranges[j].q
+	})
+	return ranges
+}
+
+// specificity is 2 for a media type, 1 for type/* and 0 for */*.
+func (r acceptRange) specificity() int {
+	switch {
+	case r.mediaType == "*/*":
+		return 0
+	case strings.HasSuffix(r.mediaType, "/*"):
+		return 1
+	}
+	return 2
+}
+
+// matches reports whether the range covers a media type.
+func (r acceptRange) matches(mediaType string) bool {
+	switch r.specificity() {
+	case 0:
+		return true
+	case 1:
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(r.mediaType, "*"))
+	}
+	return r.mediaType == mediaType
+}
+
+// acceptable reports whether the most specific range covering a media type
+// has a quality above zero, and whether any range covers it at all.
+func acceptable(ranges []acceptRange, mediaType string) (bool, bool) {
+	specificity := -1
+	var q float64
+	for _, r := range ranges {
+		if r.matches(mediaType) && r.specificity() > specificity {
+			specificity, q = r.specificity(), r.q
+		}
+	}
+	return q > 0, specificity >= 0
+}
+
+// negotiateRenderer picks the renderer named by the format query parameter or,
+// without one, the supported type of highest quality in the Accept header,
+// taking listed types before wildcards of the same quality. CSV is the default
+// unless the header refuses it.
+func negotiateRenderer(options ReportOptions) (Renderer, error) {
+	if format := options.Get("format"); format != "" {
+		renderer, ok := renderers[format]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown format %q", ErrInvalidReport, format)
+		}
+		return renderer, nil
+	}
+	ranges := parseAccept(options.Accept)
+	for _, r := range ranges {
+		if r.q == 0 {
+			break
+		}
+		for _, mediaType := range mediaTypeOrder {
+			if !r.matches(mediaType) {
+				continue
+			}
+			// a wildcard does not bring back a type refused on its own
+			if ok, _ := acceptable(ranges, mediaType); ok {
+				return renderers[mediaTypes[mediaType]], nil
+			}
+		}
+	}
+	if ok, listed := acceptable(ranges, "text/csv"); !ok && listed {
+		return nil, ErrNotAcceptable
+	}
+	return renderers["csv"], nil
+}
+
+// formatValue renders a value as text for formats without their own types.
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (CSVRenderer) ContentType() string {
+	return "text/csv"
+}
+
+// csvField quotes a field if it contains a separator, a quote or a line break.
+func csvField(s string) string {
+	if !strings.ContainsAny(s, ",\"\r\n") {
+		return s
+	}
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+func (CSVRenderer) Render(w io.Writer, table *Table) error {
+	buf := bufio.NewWriter(w)
+	for i, column := range table.Columns {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(csvField(column))
+	}
+	for _, row := range table.Rows {
+		buf.WriteByte('\n')
+		for i, value := range row {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(csvField(formatValue(value)))
+		}
+	}
+	return buf.Flush()
+}
+
+// writeObject writes a row as a JSON object keeping the order of the columns.
+func writeObject(buf *bufio.Writer, columns []string, row []interface{}) error {
+	buf.WriteByte('{')
+	for i, column := range columns {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(column)
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(row[i])
+		if err != nil {
+			return err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+func (JSONRenderer) ContentType() string {
+	return "application/json; charset=utf-8"
+}
+
+func (JSONRenderer) Render(w io.Writer, table *Table) error {
+	buf := bufio.NewWriter(w)
+	buf.WriteByte('[')
+	for i, row := range table.Rows {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		err := writeObject(buf, table.Columns, row)
+		if err != nil {
+			return err
+		}
+	}
+	buf.WriteByte(']')
+	return buf.Flush()
+}
+
+func (NDJSONRenderer) ContentType() string {
+	return "application/x-ndjson"
+}
+
+func (NDJSONRenderer) Render(w io.Writer, table *Table) error {
+	buf := bufio.NewWriter(w)
+	for _, row := range table.Rows {
+		err := writeObject(buf, table.Columns, row)
+		if err != nil {
+			return err
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Flush()
+}
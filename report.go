@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func countPeaks(rows *sql.Rows) (peakStartTime time.Time, peakEndTime time.Time, peakCount int) {
+	var currentCount int
+
+	for rows.Next() {
+		var timeValueString sql.NullString
+		var timeValue time.Time
+		var change int
+		err := rows.Scan(&timeValueString, &change)
+		if err != nil {
+			log.Printf("countPeaks failed: %v\n", err)
+			return
+		}
+		timeValue, err = time.Parse(time.RFC3339, timeValueString.String)
+		if err != nil {
+			log.Printf("countPeaks error: %v\n", err)
+			continue
+		}
+		currentCount += change
+		if currentCount > peakCount {
+			peakCount = currentCount
+			peakStartTime = timeValue
+			peakEndTime = peakStartTime
+		} else if peakEndTime == peakStartTime {
+			peakEndTime = timeValue
+		}
+	}
+	return peakStartTime, peakEndTime, peakCount
+}
+
+// reportFilter collects the WHERE conditions of a report query. Conditions are
+// written with a single "?" which is replaced by the next numbered placeholder.
+// Times of the report are displayed in loc.
+type reportFilter struct {
+	conds []string
+	args  []interface{}
+	loc   *time.Location
+}
+
+// reportTimeLayouts are accepted for from and to. Times without an offset are
+// read in the report time zone.
+var reportTimeLayouts = []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"}
+
+func parseReportTime(s string, loc *time.Location) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		return t, nil
+	}
+	for _, layout := range reportTimeLayouts {
+		t, err := time.ParseInLocation(layout, s, loc)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%w: incorrect time %q", ErrInvalidReport, s)
+}
+
+// ReportOptions are the parameters of a report, read from the query string of
+// /report or from the arguments of the report command, together with the tenant
+// whose events it covers and the Accept header used when no format is given.
+type ReportOptions struct {
+	Values url.Values
+	Tenant string
+	Accept string
+}
+
+// Get returns the first value of a parameter, or an empty string.
+func (options ReportOptions) Get(name string) string {
+	return options.Values.Get(name)
+}
+
+// Default returns the first value of a parameter, or fallback if it is missing.
+func (options ReportOptions) Default(name string, fallback string) string {
+	if values, ok := options.Values[name]; ok && len(values) > 0 {
+		return values[0]
+	}
+	return fallback
+}
+
+// Map returns the parameters written as name[key]=value by key.
+func (options ReportOptions) Map(name string) map[string]string {
+	params := make(map[string]string)
+	for param, values := range options.Values {
+		if len(values) > 0 && strings.HasPrefix(param, name+"[") && strings.HasSuffix(param, "]") {
+			params[param[len(name)+1:len(param)-1]] = values[0]
+		}
+	}
+	return params
+}
+
+// newReportFilter reads the event, from, to and tz parameters shared by all
+// reports. The range selects sessions that joined at or after from and before to.
+// Keys bound to a tenant only see the events of the tenant.
+func newReportFilter(options ReportOptions) (*reportFilter, error) {
+	filter := &reportFilter{loc: time.UTC}
+	if options.Tenant != "" {
+		filter.where(`"eventId" IN (SELECT "eventId" FROM "events" WHERE "tenant" = ?)`, options.Tenant)
+	}
+	if options.Get("tz") != "" {
+		loc, err := time.LoadLocation(options.Get("tz"))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidReport, err)
+		}
+		filter.loc = loc
+	}
+	if options.Get("event") != "" {
+		filter.where(`"eventId" = ?`, options.Get("event"))
+	}
+	if options.Get("from") != "" {
+		from, err := parseReportTime(options.Get("from"), filter.loc)
+		if err != nil {
+			return nil, err
+		}
+		filter.where(`"joinTime" >= ?`, storedTime(from))
+	}
+	if options.Get("to") != "" {
+		to, err := parseReportTime(options.Get("to"), filter.loc)
+		if err != nil {
+			return nil, err
+		}
+		filter.where(`"joinTime" < ?`, storedTime(to))
+	}
+	return filter, nil
+}
+
+func (filter *reportFilter) where(cond string, arg interface{}) {
+	filter.args = append(filter.args, arg)
+	filter.conds = append(filter.conds, strings.Replace(cond, "?", "$"+strconv.Itoa(len(filter.args)), 1))
+}
+
+func (filter *reportFilter) String() string {
+	if len(filter.conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(filter.conds, " AND ")
+}
+
+// ErrInvalidReport marks errors caused by the report request rather than by the database.
+var ErrInvalidReport = errors.New("invalid report request")
+
+// groupReports count sessions and distinct viewers grouped by a single column.
+var groupReports = map[string]string{
+	"platformName":          `COALESCE("platformName", 'unknown')`,
+	"browserClientName":     `COALESCE("browserClientName", 'unknown')`,
+	"browserClient":         `COALESCE("browserClientName", 'unknown') || ' ' || COALESCE("browserClientVersion", 'unknown')`,
+	"screenData_resolution": `"screenData_resolutionX" || 'x' || "screenData_resolutionY"`,
+	"userCountry":           `"userCountry"`,
+	"userCity":              `"userCity"`,
+	"userRegion":            `"userRegion"`,
+	"userProvider":          `"userProvider"`,
+	"eventId":               `COALESCE(NULLIF("eventId", ''), 'unknown')`,
+}
+
+func (stat *Stat) groupReport(name string, column string, filter *reportFilter) (*Table, error) {
+	sqlStr := `SELECT ` + column + ` AS "value", count(*), count(DISTINCT "viewerId") FROM "stats"` + filter.String() + ` GROUP BY "value" ORDER BY "value"`
+	rows, err := stat.conn.Query(sqlStr, filter.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			log.Printf("Close failed: %v\n", err)
+		}
+	}(rows)
+
+	table := NewTable(name, name, "count", "viewers")
+	for rows.Next() {
+		var value sql.NullString
+		var cnt int64
+		var viewers int64
+		err := rows.Scan(&value, &cnt, &viewers)
+		if err != nil {
+			return nil, err
+		}
+		if value.Valid {
+			table.Append(value.String, cnt, viewers)
+		} else {
+			table.Append(nil, cnt, viewers)
+		}
+	}
+	return table, rows.Err()
+}
+
+func (stat *Stat) viewsPeaksReport(filter *reportFilter) (*Table, error) {
+	sqlStr := `SELECT "joinTime", 1 FROM stats` + filter.String() + ` UNION ALL SELECT "leaveTime", -1 FROM stats` + filter.String() + ` ORDER BY "joinTime"`
+	rows, err := stat.conn.Query(sqlStr, filter.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			log.Printf("Close failed: %v\n", err)
+		}
+	}(rows)
+	peakStartTime, peakEndTime, peakCount := countPeaks(rows)
+	table := NewTable("viewsPeaks", "startTime", "endTime", "count")
+	table.Append(peakStartTime, peakEndTime, peakCount)
+	return table, nil
+}
+
+// report builds the table of a single report. Reports are selected by the
+// dimensions, platformName, browserClientName or column query parameters.
+func (stat *Stat) report(options ReportOptions, column string) (*Table, error) {
+	filter, err := newReportFilter(options)
+	if err != nil {
+		return nil, err
+	}
+	table, err := stat.reportTable(options, column, filter)
+	if err != nil {
+		return nil, err
+	}
+	table.In(filter.loc)
+	return table, nil
+}
+
+func (stat *Stat) reportTable(options ReportOptions, column string, filter *reportFilter) (*Table, error) {
+	if options.Get("dimensions") != "" {
+		return stat.queryReport(options, filter)
+	} else if options.Get("platformName") != "" {
+		filter.where(`"platformName" = ?`, options.Get("platformName"))
+		return stat.groupReport("platformVersion", `COALESCE("platformVersion", 'unknown')`, filter)
+	} else if options.Get("browserClientName") != "" {
+		filter.where(`"browserClientName" = ?`, options.Get("browserClientName"))
+		return stat.groupReport("browserClientVersion", `COALESCE("browserClientVersion", 'unknown')`, filter)
+	}
+
+	if expression, ok := groupReports[column]; ok {
+		table, ok, err := stat.rollupReport(options, column, filter)
+		if ok || err != nil {
+			return table, err
+		}
+		return stat.groupReport(column, expression, filter)
+	}
+	switch column {
+	case "concurrency", "concurrencyPeaks":
+		return stat.concurrencyReport(options, column, filter)
+	case "engagement", "engagementHistogram", "engagementEvents":
+		return stat.engagementReport(options, column, filter)
+	case "attendance":
+		return stat.attendanceReport(options, filter)
+	case "retention":
+		return stat.retentionReport(options, filter)
+	case "viewsPeaks":
+		return stat.viewsPeaksReport(filter)
+	default:
+		return nil, fmt.Errorf("%w: unknown column %q", ErrInvalidReport, column)
+	}
+}
+
+// reports builds one table per column query parameter. Only workbook formats
+// can hold more than one report.
+func (stat *Stat) reports(options ReportOptions, renderer Renderer) ([]*Table, error) {
+	columns := options.Values["column"]
+	if len(columns) <= 1 || options.Get("dimensions") != "" || options.Get("platformName") != "" || options.Get("browserClientName") != "" {
+		table, err := stat.report(options, options.Get("column"))
+		if err != nil {
+			return nil, err
+		}
+		return []*Table{table}, nil
+	}
+	if _, ok := renderer.(WorkbookRenderer); !ok {
+		return nil, fmt.Errorf("%w: several columns need a workbook format", ErrInvalidReport)
+	}
+	tables := make([]*Table, 0, len(columns))
+	for _, column := range columns {
+		table, err := stat.report(options, column)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+// ReportResult is a rendered report.
+type ReportResult struct {
+	ContentType string
+	Body        []byte
+	// Filename is set for reports downloaded as an attachment.
+	Filename string
+}
+
+// RunReport builds and renders the reports selected by the options. Errors
+// caused by the options wrap ErrInvalidReport.
+func (stat *Stat) RunReport(options ReportOptions) (*ReportResult, error) {
+	if options.Get("column") == "attendance" && options.Get("format") == "signed" {
+		return stat.signedAttendanceReport(options)
+	}
+	renderer, err := negotiateRenderer(options)
+	if err != nil {
+		return nil, err
+	}
+	tables, err := stat.reports(options, renderer)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ReportResult{ContentType: renderer.ContentType()}
+	var body bytes.Buffer
+	if workbook, ok := renderer.(WorkbookRenderer); ok {
+		err = workbook.RenderAll(&body, tables)
+		result.Filename = "report.xlsx"
+	} else {
+		err = renderer.Render(&body, tables[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.Body = body.Bytes()
+	return result, nil
+}
+
+func (stat *Stat) Report(c *gin.Context) {
+	result, err := stat.RunReport(ReportOptions{Values: c.Request.URL.Query(), Tenant: tenantOf(c), Accept: c.GetHeader("Accept")})
+	if errors.Is(err, ErrNotAcceptable) {
+		c.String(http.StatusNotAcceptable, "failed")
+		log.Printf("Report failed: %v\n", err)
+		return
+	} else if errors.Is(err, ErrInvalidReport) {
+		c.String(http.StatusBadRequest, "failed")
+		log.Printf("Report failed: %v\n", err)
+		return
+	} else if err != nil {
+		c.String(http.StatusInternalServerError, "Internal server error")
+		log.Printf("Report failed: %v\n", err)
+		return
+	}
+	if result.Filename != "" {
+		c.Header("Content-Disposition", `attachment; filename="`+result.Filename+`"`)
+	}
+	c.Data(http.StatusOK, result.ContentType, result.Body)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+const maxRetentionPoints = 100000
+
+type RetentionPoint struct {
+	Minute    int     `json:"minute"`
+	Joined    int     `json:"joined"`
+	Watching  int     `json:"watching"`
+	Retention float64 `json:"retention"`
+}
+
+// eventStart returns the scheduled start of the event, if it is known and the
+// event belongs to the tenant.
+func (stat *Stat) eventStart(eventId string, tenant string) (time.Time, bool) {
+	sqlStr := `SELECT "scheduledStart" FROM "events" WHERE "eventId" = $1`
+	args := []interface{}{eventId}
+	if tenant != "" {
+		sqlStr += ` AND "tenant" = $2`
+		args = append(args, tenant)
+	}
+	var scheduledStart sql.NullString
+	err := stat.conn.QueryRow(sqlStr, args...).Scan(&scheduledStart)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("eventStart failed: %v\n", err)
+		}
+		return time.Time{}, false
+	}
+	start, err := time.Parse(time.RFC3339, scheduledStart.String)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return start, true
+}
+
+// retentionCurve samples every step since start: how many viewers have joined by
+// then and how many of them are still watching. Reconnects are merged, so every
+// viewer is counted once.
+func retentionCurve(sessions []sessionInterval, start time.Time, step time.Duration) ([]RetentionPoint, error) {
+	merged := mergeIntervals(sessions)
+	if len(merged) == 0 {
+		return []RetentionPoint{}, nil
+	}
+
+	firstJoins := make(map[eventViewerKey]time.Time)
+	var end time.Time
+	for _, session := range merged {
+		if first, ok := firstJoins[session.viewer()]; !ok || session.join.Before(first) {
+			firstJoins[session.viewer()] = session.join
+		}
+		if session.leave.After(end) {
+			end = session.leave
+		}
+	}
+	joins := make([]time.Time, 0, len(firstJoins))
+	for _, join := range firstJoins {
+		joins = append(joins, join)
+	}
+	sort.Slice(joins, func(i, j int) bool { return joins[i].Before(joins[j]) })
+
+	n := int(end.Sub(start)/step) + 1
+	if n < 1 {
+		n = 1
+	}
+	if n > maxRetentionPoints {
+		return nil, fmt.Errorf("too many points: %v", n)
+	}
+	segments := concurrencySegments(merged)
+	points := make([]RetentionPoint, 0, n)
+	var joined, segment int
+	for i := 0; i < n; i++ {
+		t := start.Add(time.Duration(i) * step)
+		for joined < len(joins) && !joins[joined].After(t) {
+			joined++
+		}
+		for segment < len(segments) && !segments[segment].end.After(t) {
+			segment++
+		}
+		point := RetentionPoint{Minute: int(time.Duration(i) * step / time.Minute), Joined: joined}
+		if segment < len(segments) && !segments[segment].start.After(t) {
+			point.Watching = segments[segment].count
+		}
+		if joined > 0 {
+			point.Retention = math.Round(float64(point.Watching)/float64(joined)*10000) / 100
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+func (stat *Stat) retentionReport(options ReportOptions, filter *reportFilter) (*Table, error) {
+	sessions, err := stat.sessionIntervals(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	start, ok := stat.eventStart(options.Get("event"), options.Tenant)
+	if !ok {
+		for i, session := range sessions {
+			if i == 0 || session.join.Before(start) {
+				start = session.join
+			}
+		}
+	}
+	points, err := retentionCurve(sessions, start, time.Minute)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidReport, err)
+	}
+
+	table := NewTable("retention", "minute", "joined", "watching", "retention")
+	for _, point := range points {
+		table.Append(point.Minute, point.Joined, point.Watching, point.Retention)
+	}
+	return table, nil
+}
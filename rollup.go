@@ -0,0 +1,395 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultRollupInterval = time.Minute
+
+// rollupDimensions are the group report columns kept pre-aggregated.
+var rollupDimensions = []string{"platformName", "browserClientName", "userRegion", "userProvider", "screenData_resolution"}
+
+func isRollupDimension(column string) bool {
+	for _, dimension := range rollupDimensions {
+		if dimension == column {
+			return true
+		}
+	}
+	return false
+}
+
+// rollupGranularity is a rollup table together with the width of its buckets.
+type rollupGranularity struct {
+	table string
+	step  time.Duration
+}
+
+var rollupGranularities = []rollupGranularity{
+	{table: "rollups_hourly", step: time.Hour},
+	{table: "rollups_daily", step: 24 * time.Hour},
+}
+
+// rollupKey identifies a row of a rollup table within one event.
+type rollupKey struct {
+	bucket    time.Time
+	dimension string
+	value     sql.NullString
+}
+
+// rollupCount holds the sessions that joined within a bucket and the viewers
+// first seen in it, so that viewers add up to distinct viewers over buckets.
+type rollupCount struct {
+	sessions int
+	viewers  int
+}
+
+type rollupPending struct {
+	eventId string
+	since   time.Time
+	version int
+}
+
+// markRollup records that the rollups of an event are stale from joinTime on.
+// Every mark bumps the version, so a refresh running at the same time does not
+// clear it.
+func (stat *Stat) markRollup(tx *sql.Tx, eventId string, joinTime string) error {
+	since := stat.storage.Excluded("since")
+	_, err := tx.Exec(`INSERT INTO "rollups_pending"("eventId","since","version") VALUES ($1,$2,1) `+stat.storage.OnConflict("eventId")+` "since" = CASE WHEN `+since+` < "rollups_pending"."since" THEN `+since+` ELSE "rollups_pending"."since" END, "version" = "rollups_pending"."version" + 1`, eventId, joinTime)
+	return err
+}
+
+// rollupSeen marks a viewer as seen with a value of a dimension.
+type rollupSeen struct {
+	dimension string
+	value     sql.NullString
+	viewerId  int32
+}
+
+// rollupColumns returns the expressions of the rollup dimensions.
+func rollupColumns() string {
+	columns := make([]string, len(rollupDimensions))
+	for i, dimension := range rollupDimensions {
+		columns[i] = groupReports[dimension]
+	}
+	return strings.Join(columns, ", ")
+}
+
+// seenBefore returns the dimension values of the viewers joining from since on
+// that they were already seen with before since. Only the earlier sessions of
+// those viewers are read.
+func (stat *Stat) seenBefore(eventId string, since time.Time) (map[rollupSeen]bool, error) {
+	rows, err := stat.conn.Query(`SELECT DISTINCT "viewerId", `+rollupColumns()+` FROM "stats" WHERE "eventId" = $1 AND "joinTime" < $2 AND "viewerId" IN (SELECT "viewerId" FROM "stats" WHERE "eventId" = $1 AND "joinTime" >= $2)`, eventId, storedTime(since))
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			log.Printf("Close failed: %v\n", err)
+		}
+	}(rows)
+
+	seen := make(map[rollupSeen]bool)
+	for rows.Next() {
+		var viewerId int32
+		values := make([]sql.NullString, len(rollupDimensions))
+		dest := []interface{}{&viewerId}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		err := rows.Scan(dest...)
+		if err != nil {
+			return nil, err
+		}
+		for i, dimension := range rollupDimensions {
+			seen[rollupSeen{dimension: dimension, value: values[i], viewerId: viewerId}] = true
+		}
+	}
+	return seen, rows.Err()
+}
+
+// aggregateRollups counts the sessions of an event that joined from since on
+// per bucket and dimension value. Viewers count in the bucket they were first
+// seen in, so the earlier sessions of those viewers are looked up as well.
+func (stat *Stat) aggregateRollups(eventId string, since time.Time) ([]map[rollupKey]*rollupCount, error) {
+	seen, err := stat.seenBefore(eventId, since)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stat.conn.Query(`SELECT "viewerId", "joinTime", `+rollupColumns()+` FROM "stats" WHERE "eventId" = $1 AND "joinTime" >= $2 ORDER BY "joinTime"`, eventId, storedTime(since))
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			log.Printf("Close failed: %v\n", err)
+		}
+	}(rows)
+
+	counts := make([]map[rollupKey]*rollupCount, len(rollupGranularities))
+	for i := range counts {
+		counts[i] = make(map[rollupKey]*rollupCount)
+	}
+	for rows.Next() {
+		var viewerId int32
+		var joinTime sql.NullString
+		values := make([]sql.NullString, len(rollupDimensions))
+		dest := []interface{}{&viewerId, &joinTime}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		err := rows.Scan(dest...)
+		if err != nil {
+			return nil, err
+		}
+		join, err := time.Parse(time.RFC3339, joinTime.String)
+		if err != nil {
+			log.Printf("Rollup skipped session of %v: %v\n", viewerId, err)
+			continue
+		}
+
+		for i, dimension := range rollupDimensions {
+			key := rollupSeen{dimension: dimension, value: values[i], viewerId: viewerId}
+			first := !seen[key]
+			seen[key] = true
+			for j, granularity := range rollupGranularities {
+				bucket := join.UTC().Truncate(granularity.step)
+				bucketKey := rollupKey{bucket: bucket, dimension: dimension, value: values[i]}
+				count := counts[j][bucketKey]
+				if count == nil {
+					count = &rollupCount{}
+					counts[j][bucketKey] = count
+				}
+				count.sessions++
+				if first {
+					count.viewers++
+				}
+			}
+		}
+	}
+	return counts, rows.Err()
+}
+
+// refreshRollup rebuilds the buckets of an event from the day of its earliest
+// pending session on.
+func (stat *Stat) refreshRollup(pending rollupPending) error {
+	since := pending.since.UTC().Truncate(24 * time.Hour)
+	counts, err := stat.aggregateRollups(pending.eventId, since)
+	if err != nil {
+		return err
+	}
+
+	tx, err := stat.conn.Begin()
+	if err != nil {
+		return err
+	}
+	for i, granularity := range rollupGranularities {
+		_, err = tx.Exec(`DELETE FROM "`+granularity.table+`" WHERE "eventId" = $1 AND "bucket" >= $2`, pending.eventId, storedTime(since))
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		for key, count := range counts[i] {
+			_, err = tx.Exec(`INSERT INTO "`+granularity.table+`"("eventId","bucket","dimension","value","sessions","viewers") VALUES ($1,$2,$3,$4,$5,$6)`,
+				pending.eventId, storedTime(key.bucket), key.dimension, key.value, count.sessions, count.viewers)
+			if err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+		}
+	}
+	_, err = tx.Exec(`DELETE FROM "rollups_pending" WHERE "eventId" = $1 AND "version" = $2`, pending.eventId, pending.version)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// RefreshRollups brings the rollups of every event with pending sessions up to date.
+func (stat *Stat) RefreshRollups() error {
+	rows, err := stat.conn.Query(`SELECT "eventId", "since", "version" FROM "rollups_pending"`)
+	if err != nil {
+		return err
+	}
+	var pending []rollupPending
+	for rows.Next() {
+		var p rollupPending
+		var since string
+		err := rows.Scan(&p.eventId, &since, &p.version)
+		if err != nil {
+			_ = rows.Close()
+			return err
+		}
+		p.since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			log.Printf("Rollup of %q starts from the beginning: %v\n", p.eventId, err)
+		}
+		pending = append(pending, p)
+	}
+	err = rows.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range pending {
+		err := stat.refreshRollup(p)
+		if err != nil {
+			return fmt.Errorf("rollup of %q: %w", p.eventId, err)
+		}
+	}
+	return nil
+}
+
+// WatchRollups periodically refreshes the rollups until stop is closed.
+func (stat *Stat) WatchRollups(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := stat.RefreshRollups()
+			if err != nil {
+				log.Printf("Refresh rollups failed: %v\n", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// rollupReport answers a group report from the rollups when they give the same
+// result as the sessions: the report covers one event, has no start of range,
+// as viewers are counted in the bucket they were first seen in, and its end of
+// range falls on a bucket boundary. While sessions of the event are pending,
+// the buckets before the earliest pending session come from the rollups and
+// the later sessions are aggregated the way a refresh would, so an event still
+// receiving sessions is served from the rollups as well. The server refreshes
+// the rollups every rollup interval, the import and report commands refresh
+// them when they run.
+func (stat *Stat) rollupReport(options ReportOptions, column string, filter *reportFilter) (*Table, bool, error) {
+	eventId := options.Get("event")
+	if eventId == "" || options.Get("from") != "" || !isRollupDimension(column) {
+		return nil, false, nil
+	}
+	var to time.Time
+	if options.Get("to") != "" {
+		var err error
+		to, err = parseReportTime(options.Get("to"), filter.loc)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	index := -1
+	for i := len(rollupGranularities) - 1; i >= 0; i-- {
+		if to.Equal(to.Truncate(rollupGranularities[i].step)) {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return nil, false, nil
+	}
+	granularity := rollupGranularities[index]
+
+	owns, err := stat.ownsEvent(eventId, options.Tenant)
+	if err != nil || !owns {
+		return nil, false, err
+	}
+	pending := false
+	var cut time.Time
+	var since string
+	err = stat.conn.QueryRow(`SELECT "since" FROM "rollups_pending" WHERE "eventId" = $1`, eventId).Scan(&since)
+	if err == nil {
+		pending = true
+		cut, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			log.Printf("Rollup of %q is pending from the beginning: %v\n", eventId, err)
+		}
+		cut = cut.UTC().Truncate(granularity.step)
+	} else if err != sql.ErrNoRows {
+		return nil, false, err
+	}
+
+	sqlStr := `SELECT "value", sum("sessions"), sum("viewers") FROM "` + granularity.table + `" WHERE "eventId" = $1 AND "dimension" = $2`
+	args := []interface{}{eventId, column}
+	if !to.IsZero() {
+		args = append(args, storedTime(to))
+		sqlStr += fmt.Sprintf(` AND "bucket" < $%d`, len(args))
+	}
+	if pending {
+		args = append(args, storedTime(cut))
+		sqlStr += fmt.Sprintf(` AND "bucket" < $%d`, len(args))
+	}
+	rows, err := stat.conn.Query(sqlStr+` GROUP BY "value"`, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			log.Printf("Close failed: %v\n", err)
+		}
+	}(rows)
+
+	totals := make(map[sql.NullString]*rollupCount)
+	for rows.Next() {
+		var value sql.NullString
+		count := &rollupCount{}
+		err := rows.Scan(&value, &count.sessions, &count.viewers)
+		if err != nil {
+			return nil, false, err
+		}
+		totals[value] = count
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, false, err
+	}
+
+	if pending && (to.IsZero() || cut.Before(to)) {
+		counts, err := stat.aggregateRollups(eventId, cut)
+		if err != nil {
+			return nil, false, err
+		}
+		for key, count := range counts[index] {
+			if key.dimension != column || (!to.IsZero() && !key.bucket.Before(to)) {
+				continue
+			}
+			total := totals[key.value]
+			if total == nil {
+				total = &rollupCount{}
+				totals[key.value] = total
+			}
+			total.sessions += count.sessions
+			total.viewers += count.viewers
+		}
+	}
+
+	values := make([]sql.NullString, 0, len(totals))
+	for value := range totals {
+		values = append(values, value)
+	}
+	// values are ordered as in the group report, the unknown one first
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].Valid != values[j].Valid {
+			return !values[i].Valid
+		}
+		return values[i].String < values[j].String
+	})
+	table := NewTable(column, column, "count", "viewers")
+	for _, value := range values {
+		if value.Valid {
+			table.Append(value.String, totals[value].sessions, totals[value].viewers)
+		} else {
+			table.Append(nil, totals[value].sessions, totals[value].viewers)
+		}
+	}
+	return table, true, nil
+}
@@ -12,10 +12,29 @@ func Logging(c *gin.Context) {
 
 func (stat *Stat) Router() *gin.Engine {
 	router := gin.New()
-	router.Use(Logging)
+	if stat.requestLog {
+		router.Use(Logging)
+	}
+	collect := stat.Authorize(ScopeCollect)
+	report := stat.Authorize(ScopeReport)
+	admin := stat.Authorize(ScopeAdmin)
 	router.GET("/ping", stat.Ping)
-	router.GET("/stat", stat.Stats)
-	router.POST("/collect", stat.Collect)
-	router.GET("/report", stat.Report)
+	router.GET("/stat", report, stat.Stats)
+	router.POST("/collect", collect, stat.Collect)
+	router.POST("/collect/stream", collect, stat.CollectStream)
+	router.POST("/collect/csv", collect, stat.CollectCSV)
+	router.GET("/report", report, stat.Report)
+	router.POST("/heartbeat", collect, stat.Heartbeat)
+	router.GET("/events", report, stat.Events)
+	router.POST("/events", collect, stat.CreateEvent)
+	router.GET("/events/:event", report, stat.Event)
+	router.GET("/events/:event/live", report, stat.Live)
+	router.GET("/events/:event/live/stream", report, stat.LiveStream)
+	router.POST("/events/:event/collect", collect, stat.Collect)
+	router.POST("/events/:event/collect/stream", collect, stat.CollectStream)
+	router.POST("/events/:event/collect/csv", collect, stat.CollectCSV)
+	router.GET("/admin/keys", admin, stat.Keys)
+	router.POST("/admin/keys", admin, stat.CreateKey)
+	router.DELETE("/admin/keys/:key", admin, stat.RevokeKey)
 	return router
 }
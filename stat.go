@@ -5,9 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"github.com/gin-gonic/gin"
-	"github.com/ipinfo/go/v2/ipinfo"
 	"log"
-	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -15,12 +13,36 @@ import (
 )
 
 type Stat struct {
-	conn      *sql.DB
-	startTime time.Time
+	storage      Storage
+	conn         *sql.DB
+	startTime    time.Time
+	enricher     *Enricher
+	presence     *Presence
+	signingKey   []byte
+	requestLog   bool
+	authRequired bool
 }
 
-func NewStat(conn *sql.DB, startTime time.Time) *Stat {
-	return &Stat{conn: conn, startTime: startTime}
+func NewStat(storage Storage, startTime time.Time) *Stat {
+	enricher := NewEnricher(NopResolver{}, defaultGeoCacheTTL, defaultGeoWorkers, defaultGeoTimeout)
+	return &Stat{storage: storage, conn: storage.DB(), startTime: startTime, enricher: enricher, presence: NewPresence(defaultPresenceTimeout), requestLog: true}
+}
+
+func (stat *Stat) SetEnricher(enricher *Enricher) {
+	stat.enricher = enricher
+}
+
+func (stat *Stat) SetPresence(presence *Presence) {
+	stat.presence = presence
+}
+
+func (stat *Stat) SetRequestLogging(enabled bool) {
+	stat.requestLog = enabled
+}
+
+// SetAuthRequired turns on API key authentication, which is off by default.
+func (stat *Stat) SetAuthRequired(required bool) {
+	stat.authRequired = required
 }
 
 type Resolution struct {
@@ -45,12 +67,15 @@ type BrowserClientInfo struct {
 	Platform             Platform      `json:"platform"`
 	BrowserClient        BrowserClient `json:"browserClient"`
 	UserIP               string        `json:"userIP"`
+	UserCountry          string
+	UserCity             string
 	UserRegion           string
 	UserProvider         string
 }
 
 type Viewer struct {
 	BrowserClientInfo        `json:"browserClientInfo"`
+	EventId                  string        `json:"eventId"`
 	ViewerId                 int32         `json:"viewerId"`
 	Name                     string        `json:"name"`
 	LastName                 string        `json:"lastName"`
@@ -135,149 +160,18 @@ func (stat *Stat) Ping(c *gin.Context) {
 
 func (stat *Stat) Stats(c *gin.Context) {
 	var Count int
-	err := stat.conn.QueryRow(`select count(*) from "stats"`).Scan(&Count)
+	var Viewers int
+	sqlStr := `select count(*), count(DISTINCT "viewerId") from "stats"`
+	var args []interface{}
+	if tenant := tenantOf(c); tenant != "" {
+		sqlStr += ` WHERE "eventId" IN (SELECT "eventId" FROM "events" WHERE "tenant" = $1)`
+		args = append(args, tenant)
+	}
+	err := stat.conn.QueryRow(sqlStr, args...).Scan(&Count, &Viewers)
 	if err != nil {
 		c.String(http.StatusInternalServerError, "Internal server error")
 		log.Printf("Stats failed: %v\n", err)
 		return
 	}
-	c.JSON(http.StatusBadRequest, gin.H{"count": Count, "uptime": time.Since(stat.startTime).Seconds()})
-}
-
-func (stat *Stat) Collect(c *gin.Context) {
-	sqlStr := `INSERT INTO stats("viewerId","name","lastName","isChatName","email","isChatEmail","joinTime","leaveTime","spentTime","spentTimeDeltaPercent","chatCommentsTotal","chatCommentsDeltaPercent","anotherFields","userIP","userRegion","userProvider","platformName","platformVersion","platformArchitecture","browserClientName","browserClientVersion","screenData_viewPortX","screenData_viewPortY","screenData_resolutionX","screenData_resolutionY") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,$18,$19,$20,$21,$22,$23,$24,$25)`
-	var targets []Viewer
-
-	err := c.BindJSON(&targets)
-	if err != nil {
-		log.Printf("Collect failed: %v\n", err)
-		c.JSON(http.StatusBadRequest, gin.H{"result": "failed"})
-		return
-	}
-
-	for _, t := range targets {
-		client := ipinfo.NewClient(nil, nil, "887d18d82ff5e2")
-		info, err := client.GetIPInfo(net.ParseIP(t.UserIP))
-		if err != nil {
-			log.Printf("GetIPInfo failed: %v\n", err)
-		} else {
-			t.UserRegion = info.Region
-			t.UserProvider = info.Org
-		}
-		anotherFields, _ := json.Marshal(t.AnotherFields)
-		_, err = stat.conn.Exec(sqlStr, t.ViewerId, t.Name, t.LastName, t.IsChatName, t.Email, t.IsChatEmail, t.JoinTime, t.LeaveTime, t.SpentTime, t.SpentTimeDeltaPercent, t.ChatCommentsTotal, t.ChatCommentsDeltaPercent, anotherFields, t.UserIP, t.UserRegion, t.UserProvider, t.Platform.Name, t.Platform.Version, t.Platform.Architecture, t.BrowserClient.Name, t.BrowserClient.Version, t.ScreenDataViewPort.X, t.ScreenDataViewPort.Y, t.ScreenDataResolution.X, t.ScreenDataResolution.Y)
-		if err != nil {
-			log.Printf("Collect failed: %v\n", err)
-			c.JSON(http.StatusBadRequest, gin.H{"result": "failed"})
-			return
-		}
-	}
-
-	c.JSON(http.StatusOK, gin.H{"result": "success"})
-}
-
-func countPeaks(rows *sql.Rows) (peakStartTime time.Time, peakEndTime time.Time, peakCount int) {
-	var currentCount int
-
-	for rows.Next() {
-		var timeValueString string
-		var timeValue time.Time
-		var change int
-		err := rows.Scan(&timeValueString, &change)
-		if err != nil {
-			log.Printf("countPeaks failed: %v\n", err)
-			return
-		}
-		timeValue, err = time.Parse(time.RFC3339, timeValueString)
-		if err != nil {
-			log.Printf("countPeaks error: %v\n", err)
-			continue
-		}
-		currentCount += change
-		if currentCount > peakCount {
-			peakCount = currentCount
-			peakStartTime = timeValue
-			peakEndTime = peakStartTime
-		} else if peakEndTime == peakStartTime {
-			peakEndTime = timeValue
-		}
-	}
-	return peakStartTime, peakEndTime, peakCount
-}
-
-func (stat *Stat) Report(c *gin.Context) {
-	c.Writer.Header().Set("Content-Type", "text/csv")
-	var sqlStr string
-	var rows *sql.Rows
-	var err error
-
-	if c.Query("platformName") != "" {
-		sqlStr = `SELECT COALESCE("platformVersion", "unknown"), count(*) FROM "stats" WHERE "platformName" = $1 GROUP BY "platformVersion"`
-		rows, err = stat.conn.Query(sqlStr, c.Query("platformName"))
-	} else if c.Query("browserClientName") != "" {
-		sqlStr = `SELECT COALESCE("browserClientVersion", "unknown"), count(*) FROM "stats" WHERE "browserClientName" = $1 GROUP BY "browserClientVersion"`
-		rows, err = stat.conn.Query(sqlStr, c.Query("browserClientName"))
-	} else if c.Query("column") != "" {
-		switch c.Query("column") {
-		case "platformName":
-			sqlStr = `SELECT COALESCE("platformName", "unknown"), count(*) FROM "stats" GROUP BY "platformName"`
-		case "browserClientName":
-			sqlStr = `SELECT COALESCE("browserClientName", "unknown"), count(*) FROM "stats" GROUP BY "browserClientName"`
-		case "browserClient":
-			sqlStr = `SELECT COALESCE("browserClientName", "unknown") || ' ' || COALESCE("browserClientVersion", "unknown") AS browserClient, count(*) FROM "stats" GROUP BY browserClient`
-		case "screenData_resolution":
-			sqlStr = `SELECT "screenData_resolutionX" || 'x' || "screenData_resolutionY" as screenData_resolution, count(*) FROM "stats" GROUP BY screenData_resolution`
-		case "userRegion":
-			sqlStr = `SELECT "userRegion", count(*) FROM "stats" GROUP BY "userRegion"`
-		case "userProvider":
-			sqlStr = `SELECT "userProvider", count(*) FROM "stats" GROUP BY "userProvider"`
-		case "viewsPeaks":
-			sqlStr = `SELECT "joinTime", 1 FROM stats UNION ALL SELECT "leaveTime", -1 FROM stats ORDER BY "joinTime"`
-			rows, err = stat.conn.Query(sqlStr)
-			if err != nil {
-				c.String(http.StatusInternalServerError, "Internal server error")
-				log.Printf("Report failed: %v\n", err)
-				return
-			}
-			peakStartTime, peakEndTime, peakCount := countPeaks(rows)
-			c.String(http.StatusOK, "startTime,endTime,count\n%v,%v,%v", peakStartTime, peakEndTime, peakCount)
-			return
-		default:
-			c.String(http.StatusBadRequest, "failed")
-			return
-		}
-		rows, err = stat.conn.Query(sqlStr)
-	} else {
-		c.String(http.StatusBadRequest, "failed")
-		return
-	}
-
-	if err != nil {
-		c.String(http.StatusInternalServerError, "failed")
-		log.Printf("Report failed: %v\n", err)
-		return
-	}
-	defer func(rows *sql.Rows) {
-		err := rows.Close()
-		if err != nil {
-			log.Printf("Close failed: %v\n", err)
-		}
-	}(rows)
-
-	var name string
-	var cnt int
-
-	c.String(http.StatusOK, "%s,count", c.Query("column"))
-	for rows.Next() {
-		err := rows.Scan(&name, &cnt)
-		if err != nil {
-			c.String(http.StatusInternalServerError, "failed")
-			log.Printf("Report failed: %v\n", err)
-			return
-		}
-		c.String(http.StatusOK, "\n%v,%v", name, cnt)
-		if err != nil {
-			log.Fatalf("FATAL: Report failed: %v\n", err)
-		}
-	}
+	c.JSON(http.StatusBadRequest, gin.H{"count": Count, "viewers": Viewers, "uptime": time.Since(stat.startTime).Seconds()})
 }
@@ -1,13 +1,25 @@
 package main
 
 import (
-	"database/sql"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -19,21 +31,50 @@ type TestSuite struct {
 	router *gin.Engine
 }
 
+// SetupSuite runs the suite on an in-memory SQLite database or, when
+// STAT_TEST_DSN is set, on that database after clearing it. Times are
+// compared as text, so run PostgreSQL tests with TZ=UTC.
 func (s *TestSuite) SetupSuite() {
-	db, err := sql.Open("sqlite3", "file:test1?mode=memory&cache=shared")
+	dsn := os.Getenv("STAT_TEST_DSN")
+	if dsn == "" {
+		dsn = "file:test1?mode=memory&cache=shared"
+	}
+	storage, err := NewStorage(dsn)
 	if err != nil {
 		log.Fatalf("FATAL: Error opening database: %s\n", err)
 	}
 	startTime := time.Now()
-	stat := NewStat(db, startTime)
+	stat := NewStat(storage, startTime)
 
+	if os.Getenv("STAT_TEST_DSN") != "" {
+		m, err := stat.migrator()
+		if err == nil {
+			err = m.Drop()
+		}
+		if err != nil {
+			log.Fatalf("FATAL: Error clearing database: %s\n", err)
+		}
+	}
 	err = stat.RunMigrations()
 	if err != nil {
 		log.Fatalf("FATAL: Error running migrations: %s\n", err)
 	}
+	s.stat = stat
 	s.router = stat.Router()
 }
 
+type stubResolver struct {
+	info GeoInfo
+}
+
+func (resolver stubResolver) Resolve(ip net.IP) (*GeoInfo, error) {
+	if ip == nil {
+		return nil, ErrInvalidIP
+	}
+	info := resolver.info
+	return &info, nil
+}
+
 func TestStatSuite(t *testing.T) {
 	suite.Run(t, new(TestSuite))
 }
@@ -52,16 +93,24 @@ func (s *TestSuite) TestCollect() {
 	req, _ := http.NewRequest(http.MethodPost, "/collect", strings.NewReader(body))
 	s.router.ServeHTTP(w, req)
 	assert.Equal(s.T(), http.StatusOK, w.Code)
-	assert.Equal(s.T(), "{\"result\":\"success\"}", w.Body.String())
+	assert.Equal(s.T(), "{\"result\":\"success\",\"records\":[{\"viewerId\":10366,\"joinTime\":\"2021-07-30T15:37:24+03:00\",\"status\":\"ok\"},{\"viewerId\":11181,\"joinTime\":\"2021-07-30T14:12:48+03:00\",\"status\":\"ok\"},{\"viewerId\":11281,\"joinTime\":\"2021-07-30T14:20:48+03:00\",\"status\":\"ok\"},{\"viewerId\":14281,\"joinTime\":\"2021-07-30T15:39:48+03:00\",\"status\":\"ok\"}]}", w.Body.String())
 }
 
 func (s *TestSuite) TestCollectConstraint() {
+	// the same sessions are sent again
 	body := `[{"viewerId":10366,"name":"Роман","lastName":"XXXXX","isChatName":false,"email":"aaaa@pikemedia.ru","isChatEmail":false,"joinTime":"2021-07-30T15:37:24+03:00","leaveTime":"2021-07-30T15:45:43+03:00","spentTime":461000000000,"spentTimeDeltaPercent":14,"chatCommentsTotal":0,"chatCommentsDeltaPercent":0,"anotherFields":[],"browserClientInfo":{"userIP":"62.152.34.188","platform":"OS X 10.15.7 64-bit","browserClient":"Chrome 92.0.4515.107","screenData_viewPort":"1440x900","screenData_resolution":"1440x900"}},{"viewerId":11181,"name":"Сергей","lastName":"Сергеев","isChatName":false,"email":"bbbbb@pikemedia.ru","isChatEmail":false,"joinTime":"2021-07-30T14:12:48+03:00","leaveTime":"2021-07-30T14:25:25+03:00","spentTime":676000000000,"spentTimeDeltaPercent":9,"chatCommentsTotal":0,"chatCommentsDeltaPercent":0,"anotherFields":[],"browserClientInfo":{"userIP":"79.137.131.4","platform":"Windows 10 64-bit","browserClient":"Chrome 92.0.4515.107","screenData_viewPort":"1920x1040","screenData_resolution":"1920x1080"}},{"viewerId":11281,"name":"Василий","lastName":"Александров","isChatName":false,"email":"xxxxx@pikemedia.ru","isChatEmail":false,"joinTime":"2021-07-30T14:20:48+03:00","leaveTime":"2021-07-30T15:40:25+03:00","spentTime":676000000000,"spentTimeDeltaPercent":9,"chatCommentsTotal":0,"chatCommentsDeltaPercent":0,"anotherFields":[],"browserClientInfo":{"userIP":"79.197.131.4","platform":"Windows 7 64-bit","browserClient":"Chrome 92.0.4515.100","screenData_viewPort":"1280x720","screenData_resolution":"1280x720"}},{"viewerId":14281,"name":"Александр","lastName":"Васильев","isChatName":false,"email":"zzzzz@pikemedia.ru","isChatEmail":false,"joinTime":"2021-07-30T15:39:48+03:00","leaveTime":"2021-07-30T15:50:25+03:00","spentTime":676000000000,"spentTimeDeltaPercent":9,"chatCommentsTotal":0,"chatCommentsDeltaPercent":0,"anotherFields":[],"browserClientInfo":{"userIP":"79.197.136.4","platform":"Windows 7 64-bit","browserClient":"Firefox 15.10","screenData_viewPort":"1280x700","screenData_resolution":"1280x700"}}]`
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest(http.MethodPost, "/collect", strings.NewReader(body))
 	s.router.ServeHTTP(w, req)
 	assert.Equal(s.T(), http.StatusBadRequest, w.Code)
-	assert.Equal(s.T(), "{\"result\":\"failed\"}", w.Body.String())
+	var result CollectResult
+	assert.NoError(s.T(), json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(s.T(), "failed", result.Result)
+	assert.Len(s.T(), result.Records, 4)
+	for _, record := range result.Records {
+		assert.Equal(s.T(), RecordFailed, record.Status)
+		assert.NotEmpty(s.T(), record.Error)
+	}
 }
 
 func (s *TestSuite) TestCollectIncorrectType() {
@@ -81,7 +130,7 @@ func (s *TestSuite) TestCollectNull() {
 	req, _ := http.NewRequest(http.MethodPost, "/collect", strings.NewReader(body))
 	s.router.ServeHTTP(w, req)
 	assert.Equal(s.T(), http.StatusOK, w.Code)
-	assert.Equal(s.T(), "{\"result\":\"success\"}", w.Body.String())
+	assert.Equal(s.T(), "{\"result\":\"success\",\"records\":[{\"viewerId\":12345,\"joinTime\":\"2021-07-30T15:37:24+03:00\",\"status\":\"ok\"}]}", w.Body.String())
 }
 
 func (s *TestSuite) TestCollectAbsence() {
@@ -91,7 +140,7 @@ func (s *TestSuite) TestCollectAbsence() {
 	req, _ := http.NewRequest(http.MethodPost, "/collect", strings.NewReader(body))
 	s.router.ServeHTTP(w, req)
 	assert.Equal(s.T(), http.StatusOK, w.Code)
-	assert.Equal(s.T(), "{\"result\":\"success\"}", w.Body.String())
+	assert.Equal(s.T(), "{\"result\":\"success\",\"records\":[{\"viewerId\":12346,\"joinTime\":\"2021-07-30T15:37:24+03:00\",\"status\":\"ok\"}]}", w.Body.String())
 }
 
 func (s *TestSuite) TestCollectNullPointer() {
@@ -101,7 +150,7 @@ func (s *TestSuite) TestCollectNullPointer() {
 	req, _ := http.NewRequest(http.MethodPost, "/collect", strings.NewReader(body))
 	s.router.ServeHTTP(w, req)
 	assert.Equal(s.T(), http.StatusOK, w.Code)
-	assert.Equal(s.T(), "{\"result\":\"success\"}", w.Body.String())
+	assert.Equal(s.T(), "{\"result\":\"success\",\"records\":[{\"viewerId\":12347,\"joinTime\":\"2021-07-30T15:37:24+03:00\",\"status\":\"ok\"}]}", w.Body.String())
 }
 
 func (s *TestSuite) TestCollectAbsencePointer() {
@@ -111,5 +160,981 @@ func (s *TestSuite) TestCollectAbsencePointer() {
 	req, _ := http.NewRequest(http.MethodPost, "/collect", strings.NewReader(body))
 	s.router.ServeHTTP(w, req)
 	assert.Equal(s.T(), http.StatusOK, w.Code)
-	assert.Equal(s.T(), "{\"result\":\"success\"}", w.Body.String())
+	assert.Equal(s.T(), "{\"result\":\"success\",\"records\":[{\"viewerId\":12348,\"joinTime\":\"2021-07-30T15:37:24+03:00\",\"status\":\"ok\"}]}", w.Body.String())
+}
+
+func (s *TestSuite) TestCollectGeo() {
+	geo := stubResolver{GeoInfo{Country: "Testland", City: "Testville", Region: "Test Oblast", Provider: "Test Telecom"}}
+	s.stat.SetEnricher(NewEnricher(geo, time.Minute, 2, time.Second))
+	defer s.stat.SetEnricher(NewEnricher(NopResolver{}, time.Minute, 2, time.Second))
+	body := `[{"viewerId":12349,"name":"Роман","lastName":"XXXXX","isChatName":false,"email":"aaaa@pikemedia.ru","isChatEmail":false,"joinTime":"2021-07-30T15:37:24+03:00","leaveTime":"2021-07-30T15:45:43+03:00","spentTime":461000000000,"spentTimeDeltaPercent":14,"chatCommentsTotal":0,"chatCommentsDeltaPercent":0,"anotherFields":[],"browserClientInfo":{"userIP":"62.152.34.188","platform":"OS X 10.15.7 64-bit","browserClient":"Chrome 92.0.4515.107","screenData_viewPort":"1440x900","screenData_resolution":"1440x900"}}]`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/collect", strings.NewReader(body))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=userCountry", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	assert.Contains(s.T(), w.Body.String(), "\nTestland,1,1")
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=userProvider", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Contains(s.T(), w.Body.String(), "\nTest Telecom,1,1")
+}
+
+func (s *TestSuite) TestEvents() {
+	body := `{"eventId":"webinar-1","title":"Вебинар","scheduledStart":"2021-07-30T14:00:00+03:00","scheduledEnd":"2021-07-30T16:00:00+03:00"}`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/events", strings.NewReader(body))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/events/webinar-1", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	assert.Equal(s.T(), `{"eventId":"webinar-1","title":"Вебинар","scheduledStart":"2021-07-30T14:00:00+03:00","scheduledEnd":"2021-07-30T16:00:00+03:00"}`, w.Body.String())
+
+	body = `[{"viewerId":20001,"name":"Роман","lastName":"XXXXX","isChatName":false,"email":"aaaa@pikemedia.ru","isChatEmail":false,"joinTime":"2021-07-30T14:05:00+03:00","leaveTime":"2021-07-30T15:00:00+03:00","spentTime":461000000000,"spentTimeDeltaPercent":14,"chatCommentsTotal":0,"chatCommentsDeltaPercent":0,"anotherFields":[],"browserClientInfo":{"userIP":"62.152.34.188","platform":"Linux x86_64","browserClient":"Chrome 92.0.4515.107","screenData_viewPort":"1440x900","screenData_resolution":"1440x900"}},{"viewerId":20002,"name":"Сергей","lastName":"Сергеев","isChatName":false,"email":"bbbbb@pikemedia.ru","isChatEmail":false,"joinTime":"2021-07-30T14:10:00+03:00","leaveTime":"2021-07-30T14:30:00+03:00","spentTime":676000000000,"spentTimeDeltaPercent":9,"chatCommentsTotal":0,"chatCommentsDeltaPercent":0,"anotherFields":[],"browserClientInfo":{"userIP":"79.137.131.4","platform":"Linux x86_64","browserClient":"Chrome 92.0.4515.107","screenData_viewPort":"1920x1040","screenData_resolution":"1920x1080"}}]`
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/events/webinar-1/collect", strings.NewReader(body))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=platformName&event=webinar-1", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	assert.Equal(s.T(), "platformName,count,viewers\nLinux x86_64,2,2", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=viewsPeaks&event=webinar-1&tz=Europe/Moscow", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	assert.Equal(s.T(), "startTime,endTime,count\n2021-07-30T14:10:00+03:00,2021-07-30T14:30:00+03:00,2", w.Body.String())
+}
+
+func (s *TestSuite) TestCollectSessions() {
+	// the viewer rejoins the first event and then attends the second one
+	body := `[{"eventId":"sessions-1","viewerId":30001,"name":"Роман","lastName":"XXXXX","isChatName":false,"email":"aaaa@pikemedia.ru","isChatEmail":false,"joinTime":"2021-07-30T14:05:00+03:00","leaveTime":"2021-07-30T14:20:00+03:00","spentTime":900000000000,"spentTimeDeltaPercent":14,"chatCommentsTotal":0,"chatCommentsDeltaPercent":0,"anotherFields":[],"browserClientInfo":{"userIP":"62.152.34.188","platform":"Windows 10 64-bit","browserClient":"Chrome 92.0.4515.107","screenData_viewPort":"1440x900","screenData_resolution":"1440x900"}},{"eventId":"sessions-1","viewerId":30001,"name":"Роман","lastName":"XXXXX","isChatName":false,"email":"aaaa@pikemedia.ru","isChatEmail":false,"joinTime":"2021-07-30T14:25:00+03:00","leaveTime":"2021-07-30T15:00:00+03:00","spentTime":2100000000000,"spentTimeDeltaPercent":14,"chatCommentsTotal":0,"chatCommentsDeltaPercent":0,"anotherFields":[],"browserClientInfo":{"userIP":"62.152.34.188","platform":"Windows 10 64-bit","browserClient":"Chrome 92.0.4515.107","screenData_viewPort":"1440x900","screenData_resolution":"1440x900"}},{"eventId":"sessions-2","viewerId":30001,"name":"Роман","lastName":"XXXXX","isChatName":false,"email":"aaaa@pikemedia.ru","isChatEmail":false,"joinTime":"2021-07-30T14:05:00+03:00","leaveTime":"2021-07-30T14:20:00+03:00","spentTime":900000000000,"spentTimeDeltaPercent":14,"chatCommentsTotal":0,"chatCommentsDeltaPercent":0,"anotherFields":[],"browserClientInfo":{"userIP":"62.152.34.188","platform":"Windows 10 64-bit","browserClient":"Chrome 92.0.4515.107","screenData_viewPort":"1440x900","screenData_resolution":"1440x900"}}]`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/collect", strings.NewReader(body))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	var result CollectResult
+	assert.NoError(s.T(), json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(s.T(), "success", result.Result)
+	assert.Equal(s.T(), 0, result.Failed())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=platformName&event=sessions-1", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	assert.Equal(s.T(), "platformName,count,viewers\nWindows,2,1", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=platformName&event=sessions-2", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), "platformName,count,viewers\nWindows,1,1", w.Body.String())
+}
+
+func (s *TestSuite) TestCollectModes() {
+	// the second record duplicates the first session
+	body := `[{"eventId":"modes","viewerId":40001,"name":"Роман","lastName":"XXXXX","isChatName":false,"email":"aaaa@pikemedia.ru","isChatEmail":false,"joinTime":"2021-07-30T14:05:00+03:00","leaveTime":"2021-07-30T14:20:00+03:00","spentTime":900000000000,"spentTimeDeltaPercent":14,"chatCommentsTotal":0,"chatCommentsDeltaPercent":0,"anotherFields":[],"browserClientInfo":{"userIP":"62.152.34.188","platform":"Windows 10 64-bit","browserClient":"Chrome 92.0.4515.107","screenData_viewPort":"1440x900","screenData_resolution":"1440x900"}},{"eventId":"modes","viewerId":40001,"name":"Роман","lastName":"XXXXX","isChatName":false,"email":"aaaa@pikemedia.ru","isChatEmail":false,"joinTime":"2021-07-30T14:05:00+03:00","leaveTime":"2021-07-30T14:20:00+03:00","spentTime":900000000000,"spentTimeDeltaPercent":14,"chatCommentsTotal":0,"chatCommentsDeltaPercent":0,"anotherFields":[],"browserClientInfo":{"userIP":"62.152.34.188","platform":"Windows 10 64-bit","browserClient":"Chrome 92.0.4515.107","screenData_viewPort":"1440x900","screenData_resolution":"1440x900"}},{"eventId":"modes","viewerId":40002,"name":"Сергей","lastName":"Сергеев","isChatName":false,"email":"bbbbb@pikemedia.ru","isChatEmail":false,"joinTime":"2021-07-30T14:10:00+03:00","leaveTime":"2021-07-30T14:30:00+03:00","spentTime":1200000000000,"spentTimeDeltaPercent":9,"chatCommentsTotal":0,"chatCommentsDeltaPercent":0,"anotherFields":[],"browserClientInfo":{"userIP":"79.137.131.4","platform":"Windows 10 64-bit","browserClient":"Chrome 92.0.4515.107","screenData_viewPort":"1920x1040","screenData_resolution":"1920x1080"}}]`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/collect", strings.NewReader(body))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusBadRequest, w.Code)
+	var result CollectResult
+	assert.NoError(s.T(), json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(s.T(), "failed", result.Result)
+	assert.Equal(s.T(), []string{RecordRolledBack, RecordFailed, RecordRolledBack}, []string{result.Records[0].Status, result.Records[1].Status, result.Records[2].Status})
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=platformName&event=modes", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), "platformName,count,viewers", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/collect?mode=partial", strings.NewReader(body))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	result = CollectResult{}
+	assert.NoError(s.T(), json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(s.T(), "partial", result.Result)
+	assert.Equal(s.T(), []string{RecordOk, RecordFailed, RecordOk}, []string{result.Records[0].Status, result.Records[1].Status, result.Records[2].Status})
+	assert.NotEmpty(s.T(), result.Records[1].Error)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=platformName&event=modes", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), "platformName,count,viewers\nWindows,2,2", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/collect?mode=bogus", strings.NewReader(body))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusBadRequest, w.Code)
+	assert.Equal(s.T(), `{"error":"incorrect mode \"bogus\"","result":"failed"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/collect?conflict=replace", strings.NewReader(body))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusBadRequest, w.Code)
+	assert.Equal(s.T(), `{"error":"incorrect conflict \"replace\"","result":"failed"}`, w.Body.String())
+}
+
+func (s *TestSuite) TestCollectMerge() {
+	body := `[{"eventId":"merge","viewerId":50001,"name":"Роман","lastName":"XXXXX","isChatName":false,"email":"aaaa@pikemedia.ru","isChatEmail":false,"joinTime":"2021-07-30T14:05:00+03:00","leaveTime":"2021-07-30T14:20:00+03:00","spentTime":900000000000,"spentTimeDeltaPercent":14,"chatCommentsTotal":3,"chatCommentsDeltaPercent":0,"anotherFields":[],"browserClientInfo":{"userIP":"62.152.34.188","platform":"Windows 10 64-bit","browserClient":"Chrome 92.0.4515.107","screenData_viewPort":"1440x900","screenData_resolution":"1440x900"}}]`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/collect", strings.NewReader(body))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+
+	// the final list is re-sent with a later leaveTime, fewer comments and without a platform
+	body = `[{"eventId":"merge","viewerId":50001,"name":"Роман","isChatName":false,"email":"","isChatEmail":false,"joinTime":"2021-07-30T14:05:00+03:00","leaveTime":"2021-07-30T14:50:00+03:00","spentTime":2700000000000,"spentTimeDeltaPercent":14,"chatCommentsTotal":1,"chatCommentsDeltaPercent":0,"anotherFields":[],"browserClientInfo":{"userIP":"62.152.34.188","platform":null,"browserClient":"Chrome 92.0.4515.107","screenData_viewPort":"1440x900","screenData_resolution":"1440x900"}}]`
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/collect", strings.NewReader(body))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/collect?conflict=merge", strings.NewReader(body))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	assert.Equal(s.T(), "{\"result\":\"success\",\"records\":[{\"viewerId\":50001,\"joinTime\":\"2021-07-30T14:05:00+03:00\",\"status\":\"ok\"}]}", w.Body.String())
+
+	var leaveTime, platformName, lastName, email string
+	var spentTime int64
+	var chatCommentsTotal int32
+	err := s.stat.conn.QueryRow(`SELECT s."leaveTime", s."spentTime", s."chatCommentsTotal", s."platformName", v."lastName", v."email" FROM "stats" s JOIN "viewers" v ON v."viewerId" = s."viewerId" WHERE s."eventId" = 'merge'`).
+		Scan(&leaveTime, &spentTime, &chatCommentsTotal, &platformName, &lastName, &email)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), "2021-07-30T11:50:00Z", leaveTime)
+	assert.Equal(s.T(), int64(2700000000000), spentTime)
+	assert.Equal(s.T(), int32(3), chatCommentsTotal)
+	assert.Equal(s.T(), "Windows", platformName)
+	assert.Equal(s.T(), "XXXXX", lastName)
+	assert.Equal(s.T(), "aaaa@pikemedia.ru", email)
+}
+
+func (s *TestSuite) TestCollectMergeRules() {
+	windows := "Windows"
+	stored := Viewer{
+		ViewerId:          1,
+		Name:              "Роман",
+		LastName:          "XXXXX",
+		JoinTime:          "2021-07-30T14:05:00+03:00",
+		LeaveTime:         "2021-07-30T14:50:00+03:00",
+		SpentTime:         2700,
+		ChatCommentsTotal: 1,
+		BrowserClientInfo: BrowserClientInfo{Platform: Platform{Name: &windows}, UserRegion: "Moscow"},
+	}
+	incoming := Viewer{
+		ViewerId:          1,
+		Name:              "Роман",
+		IsChatName:        true,
+		JoinTime:          "2021-07-30T14:05:00+03:00",
+		LeaveTime:         "2021-07-30T11:20:00Z",
+		SpentTime:         900,
+		ChatCommentsTotal: 4,
+	}
+
+	merged := mergeViewer(stored, incoming)
+	// 11:20Z is 14:20+03:00, so the stored leaveTime is later
+	assert.Equal(s.T(), "2021-07-30T14:50:00+03:00", merged.LeaveTime)
+	assert.Equal(s.T(), int64(2700), merged.SpentTime)
+	assert.Equal(s.T(), int32(4), merged.ChatCommentsTotal)
+	assert.Equal(s.T(), "XXXXX", merged.LastName)
+	assert.Equal(s.T(), "Moscow", merged.UserRegion)
+	assert.Equal(s.T(), &windows, merged.Platform.Name)
+	assert.True(s.T(), merged.IsChatName)
+
+	incoming.LeaveTime = "2021-07-30T15:00:00+03:00"
+	merged = mergeViewer(stored, incoming)
+	assert.Equal(s.T(), "2021-07-30T15:00:00+03:00", merged.LeaveTime)
+}
+
+func (s *TestSuite) TestCollectStream() {
+	lines := []string{
+		`{"viewerId":60001,"name":"Роман","lastName":"XXXXX","email":"aaaa@pikemedia.ru","joinTime":"2021-07-30T14:05:00+03:00","leaveTime":"2021-07-30T14:20:00+03:00","spentTime":900000000000,"browserClientInfo":{"userIP":"62.152.34.188","platform":"Windows 10 64-bit","browserClient":"Chrome 92.0.4515.107","screenData_viewPort":"1440x900","screenData_resolution":"1440x900"}}`,
+		`{"viewerId":"60002"}`,
+		``,
+		`{"viewerId":60003,"name":"Сергей","lastName":"Сергеев","email":"bbbbb@pikemedia.ru","joinTime":"2021-07-30T14:10:00+03:00","leaveTime":"2021-07-30T14:30:00+03:00","spentTime":1200000000000,"browserClientInfo":{"userIP":"79.137.131.4","platform":"Windows 10 64-bit","browserClient":"Chrome 92.0.4515.107","screenData_viewPort":"1920x1040","screenData_resolution":"1920x1080"}}`,
+		`{"viewerId":60001,"name":"Роман","lastName":"XXXXX","email":"aaaa@pikemedia.ru","joinTime":"2021-07-30T14:05:00+03:00","leaveTime":"2021-07-30T14:20:00+03:00","spentTime":900000000000,"browserClientInfo":{"userIP":"62.152.34.188","platform":"Windows 10 64-bit","browserClient":"Chrome 92.0.4515.107","screenData_viewPort":"1440x900","screenData_resolution":"1440x900"}}`,
+	}
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	_, _ = gz.Write([]byte(strings.Join(lines, "\n")))
+	_ = gz.Close()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/events/stream/collect/stream?batch=2", &body)
+	req.Header.Set("Content-Encoding", "gzip")
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	var result StreamResult
+	assert.NoError(s.T(), json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(s.T(), "partial", result.Result)
+	assert.Equal(s.T(), 2, result.Accepted)
+	assert.Equal(s.T(), 2, result.Rejected)
+	assert.Equal(s.T(), 2, result.Errors[0].Line)
+	assert.Equal(s.T(), 5, result.Errors[1].Line)
+	assert.Equal(s.T(), int32(60001), result.Errors[1].ViewerId)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=platformName&event=stream", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), "platformName,count,viewers\nWindows,2,2", w.Body.String())
+}
+
+func (s *TestSuite) TestCollectCSV() {
+	body := "ID;Имя;Фамилия;E-mail;joinTime;leaveTime;platform;browserClient;screenData_resolution\n" +
+		"70001;Роман;XXXXX;aaaa@pikemedia.ru;2021-07-30T14:05:00+03:00;2021-07-30T14:20:00+03:00;OS X 10.15.7 64-bit;Chrome 92.0.4515.107;1440x900\n" +
+		"70002;Сергей;Сергеев;bbbbb@pikemedia.ru;2021-07-30T14:10:00+03:00;2021-07-30T14:30:00+03:00;;Firefox 15.10;1920x1080\n" +
+		"70003;Василий;;xxxxx@pikemedia.ru;2021-07-30T14:10:00+03:00;2021-07-30T14:30:00+03:00;Windows 7 64-bit;Chrome 92.0.4515.100;wide\n"
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/events/csv/collect/csv?delimiter=%3B&map[viewerId]=ID&map[name]=Имя&map[lastName]=Фамилия&map[email]=E-mail", strings.NewReader(body))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	var result StreamResult
+	assert.NoError(s.T(), json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(s.T(), 2, result.Accepted)
+	assert.Equal(s.T(), 1, result.Rejected)
+	assert.Equal(s.T(), 4, result.Errors[0].Line)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=browserClient&event=csv", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), "browserClient,count,viewers\nChrome 92.0.4515.107,1,1\nFirefox 15.10,1,1", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?platformName=OS X&event=csv", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), "platformVersion,count,viewers\n10.15.7,1,1", w.Body.String())
+}
+
+func (s *TestSuite) TestHeartbeat() {
+	for _, body := range []string{`{"eventId":"live","viewerId":80001}`, `{"eventId":"live","viewerId":80002}`, `{"eventId":"live","viewerId":80001}`} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/heartbeat", strings.NewReader(body))
+		s.router.ServeHTTP(w, req)
+		assert.Equal(s.T(), http.StatusOK, w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/events/live/live", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	assert.Equal(s.T(), "{\"eventId\":\"live\",\"viewers\":2}", w.Body.String())
+
+	// nobody is silent yet
+	s.stat.materialise(time.Now())
+	assert.Equal(s.T(), 2, s.stat.presence.Count("live"))
+
+	s.stat.materialise(time.Now().Add(time.Hour))
+	assert.Equal(s.T(), 0, s.stat.presence.Count("live"))
+	// metrics are forgotten with the last viewer and not created by reads
+	assert.NotContains(s.T(), s.stat.presence.metrics, "live")
+	assert.Equal(s.T(), 0, s.stat.presence.Metrics("unknown", time.Now()).Viewers)
+	assert.NotContains(s.T(), s.stat.presence.metrics, "unknown")
+
+	var sessions int
+	err := s.stat.conn.QueryRow(`SELECT count(*) FROM "stats" WHERE "eventId" = 'live' AND "leaveTime" >= "joinTime"`).Scan(&sessions)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), 2, sessions)
+}
+
+func (s *TestSuite) TestLiveStream() {
+	for _, body := range []string{`{"eventId":"sse","viewerId":80101}`, `{"eventId":"sse","viewerId":80102}`} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/heartbeat", strings.NewReader(body))
+		s.router.ServeHTTP(w, req)
+		assert.Equal(s.T(), http.StatusOK, w.Code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "/events/sse/live/stream?interval=100ms", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	assert.Equal(s.T(), "text/event-stream", w.Header().Get("Content-Type"))
+
+	var messages []LiveMetrics
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(line, "data:") {
+			var metrics LiveMetrics
+			assert.NoError(s.T(), json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &metrics))
+			messages = append(messages, metrics)
+		}
+	}
+	if !assert.GreaterOrEqual(s.T(), len(messages), 2) {
+		return
+	}
+	assert.Equal(s.T(), 2, messages[0].Viewers)
+	assert.Equal(s.T(), 2, messages[0].Joins)
+	assert.Equal(s.T(), 2, messages[0].Peak)
+	// joins are counted since the previous message
+	assert.Equal(s.T(), 0, messages[1].Joins)
+	assert.Equal(s.T(), 2, messages[1].Peak)
+
+	// viewers still present are stored on shutdown
+	s.stat.FlushPresence()
+	assert.Equal(s.T(), 0, s.stat.presence.Count("sse"))
+	assert.Empty(s.T(), s.stat.presence.metrics)
+	assert.Empty(s.T(), s.stat.presence.streams)
+	var sessions int
+	err := s.stat.conn.QueryRow(`SELECT count(*) FROM "stats" WHERE "eventId" = 'sse'`).Scan(&sessions)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), 2, sessions)
+}
+
+func (s *TestSuite) TestReportConcurrency() {
+	// 14:00-14:03 one viewer, 14:01-14:02 two, 14:05-14:06 three, the last two leave at 14:07.
+	// The first viewer also watches 14:01-14:02 on a second device, which does not count.
+	body := `[{"viewerId":90001,"joinTime":"2021-07-30T14:00:00+03:00","leaveTime":"2021-07-30T14:03:00+03:00"},{"viewerId":90001,"joinTime":"2021-07-30T14:01:00+03:00","leaveTime":"2021-07-30T14:02:00+03:00"},{"viewerId":90002,"joinTime":"2021-07-30T14:01:00+03:00","leaveTime":"2021-07-30T14:02:00+03:00"},{"viewerId":90003,"joinTime":"2021-07-30T14:05:00+03:00","leaveTime":"2021-07-30T14:06:00+03:00"},{"viewerId":90004,"joinTime":"2021-07-30T14:05:00+03:00","leaveTime":"2021-07-30T14:07:00+03:00"},{"viewerId":90005,"joinTime":"2021-07-30T14:05:00+03:00","leaveTime":"2021-07-30T14:07:00+03:00"}]`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/events/concurrency/collect", strings.NewReader(body))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=concurrency&event=concurrency&step=2m", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	assert.Equal(s.T(), "time,viewers\n2021-07-30T11:00:00Z,2\n2021-07-30T11:02:00Z,1\n2021-07-30T11:04:00Z,3\n2021-07-30T11:06:00Z,2", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=concurrencyPeaks&event=concurrency&top=2", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	assert.Equal(s.T(), "startTime,endTime,viewers,duration\n2021-07-30T11:05:00Z,2021-07-30T11:06:00Z,3,60\n2021-07-30T11:01:00Z,2021-07-30T11:02:00Z,2,60", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=concurrency&event=concurrency&step=10m&format=json", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(s.T(), `[{"time":"2021-07-30T11:00:00Z","viewers":3}]`, w.Body.String())
+
+	// without event the same viewerId in two events is two viewers
+	for _, eventId := range []string{"concurrency-a", "concurrency-b"} {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest(http.MethodPost, "/events/"+eventId+"/collect", strings.NewReader(`[{"viewerId":90001,"joinTime":"2021-08-02T14:00:00Z","leaveTime":"2021-08-02T14:05:00Z"}]`))
+		s.router.ServeHTTP(w, req)
+		assert.Equal(s.T(), http.StatusOK, w.Code)
+	}
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=concurrency&from=2021-08-02T00:00:00Z&to=2021-08-03T00:00:00Z&step=10m", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), "time,viewers\n2021-08-02T14:00:00Z,2", w.Body.String())
+}
+
+func (s *TestSuite) TestReportFormats() {
+	body := `[{"viewerId":20701,"name":"Роман","lastName":"XXXXX","email":"aaaa@pikemedia.ru","joinTime":"2021-07-30T14:00:00+03:00","leaveTime":"2021-07-30T14:10:00+03:00","spentTime":600000000000,"anotherFields":[],"browserClientInfo":{"userIP":"62.152.34.188","platform":"Windows, 10 64-bit","browserClient":"Chrome 92.0.4515.107","screenData_viewPort":"1440x900","screenData_resolution":"1920x1080"}}]`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/events/formats/collect", strings.NewReader(body))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=platformName&event=formats", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), "text/csv", w.Header().Get("Content-Type"))
+	assert.Equal(s.T(), "platformName,count,viewers\n\"Windows,\",1,1", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=platformName&event=formats", nil)
+	req.Header.Set("Accept", "text/html, application/json;q=0.9")
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(s.T(), `[{"platformName":"Windows,","count":1,"viewers":1}]`, w.Body.String())
+
+	// the quality decides, not the order of the types
+	accepts := map[string]string{
+		"application/json;q=0.1, text/csv":                  "text/csv",
+		"text/csv;q=0.5, application/x-ndjson;q=0.8":        "application/x-ndjson",
+		"*/*, application/json":                             "application/json; charset=utf-8",
+		"text/csv;q=0, */*":                                 "application/json; charset=utf-8",
+		"application/*;q=0.9, application/json;q=0, text/*": "text/csv",
+		"text/html": "text/csv",
+	}
+	for accept, contentType := range accepts {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest(http.MethodGet, "/report?column=platformName&event=formats", nil)
+		req.Header.Set("Accept", accept)
+		s.router.ServeHTTP(w, req)
+		assert.Equal(s.T(), http.StatusOK, w.Code, accept)
+		assert.Equal(s.T(), contentType, w.Header().Get("Content-Type"), accept)
+	}
+	for _, accept := range []string{"*/*;q=0", "text/csv;q=0, application/json;q=0, text/html"} {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest(http.MethodGet, "/report?column=platformName&event=formats", nil)
+		req.Header.Set("Accept", accept)
+		s.router.ServeHTTP(w, req)
+		assert.Equal(s.T(), http.StatusNotAcceptable, w.Code, accept)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=viewsPeaks&event=formats&format=ndjson&tz=Europe/Moscow", nil)
+	req.Header.Set("Accept", "application/json")
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), "application/x-ndjson", w.Header().Get("Content-Type"))
+	assert.Equal(s.T(), "{\"startTime\":\"2021-07-30T14:00:00+03:00\",\"endTime\":\"2021-07-30T14:10:00+03:00\",\"count\":1}\n", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=platformName&event=formats&format=xml", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusBadRequest, w.Code)
+}
+
+func (s *TestSuite) TestReportXLSX() {
+	body := `[{"viewerId":20801,"name":"Роман","lastName":"XXXXX","email":"aaaa@pikemedia.ru","joinTime":"2021-07-30T14:00:00+03:00","leaveTime":"2021-07-30T14:10:00+03:00","spentTime":600000000000,"anotherFields":[],"browserClientInfo":{"userIP":"62.152.34.188","platform":"Linux x86_64","browserClient":"Chrome 92.0.4515.107","screenData_viewPort":"1440x900","screenData_resolution":"1920x1080"}}]`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/events/xlsx/collect", strings.NewReader(body))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=platformName&column=viewsPeaks&event=xlsx&format=xlsx&tz=Europe/Moscow", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	assert.Equal(s.T(), "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", w.Header().Get("Content-Type"))
+
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	assert.NoError(s.T(), err)
+	parts := make(map[string]string)
+	for _, file := range archive.File {
+		r, err := file.Open()
+		assert.NoError(s.T(), err)
+		data, err := io.ReadAll(r)
+		assert.NoError(s.T(), err)
+		parts[file.Name] = string(data)
+	}
+	assert.Contains(s.T(), parts, "[Content_Types].xml")
+	assert.Contains(s.T(), parts["xl/workbook.xml"], `<sheet name="platformName" sheetId="1" r:id="rId1"></sheet><sheet name="viewsPeaks" sheetId="2" r:id="rId2"></sheet>`)
+	assert.Contains(s.T(), parts["xl/worksheets/sheet1.xml"], `<c r="A1" s="1" t="inlineStr"><is><t>platformName</t></is></c>`)
+	assert.Contains(s.T(), parts["xl/worksheets/sheet1.xml"], `<c r="A2" t="inlineStr"><is><t>Linux x86_64</t></is></c><c r="B2"><v>1</v></c>`)
+	assert.Contains(s.T(), parts["xl/worksheets/sheet2.xml"], `<c r="A2" s="2"><v>44407.58333`)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=platformName&column=viewsPeaks&event=xlsx", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusBadRequest, w.Code)
+}
+
+func (s *TestSuite) TestReportTimeRange() {
+	body := `[{"viewerId":20901,"joinTime":"2021-07-30T10:30:00Z","leaveTime":"2021-07-30T10:40:00Z","anotherFields":[],"browserClientInfo":{"userIP":"62.152.34.188","platform":"Linux x86_64","browserClient":"Chrome 92.0.4515.107","screenData_viewPort":"1440x900","screenData_resolution":"1920x1080"}},{"viewerId":20902,"joinTime":"2021-07-30T14:30:00+03:00","leaveTime":"2021-07-30T14:40:00+03:00","anotherFields":[],"browserClientInfo":{"userIP":"62.152.34.188","platform":"OS X 10.15.7 64-bit","browserClient":"Chrome 92.0.4515.107","screenData_viewPort":"1440x900","screenData_resolution":"1920x1080"}}]`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/events/timerange/collect", strings.NewReader(body))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=platformName&event=timerange&from=2021-07-30T13:00&to=2021-07-30T14:00&tz=Europe/Moscow", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	assert.Equal(s.T(), "platformName,count,viewers\nLinux x86_64,1,1", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=viewsPeaks&event=timerange&from=2021-07-30T11:00:00Z", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	assert.Equal(s.T(), "startTime,endTime,count\n2021-07-30T11:30:00Z,2021-07-30T11:40:00Z,1", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=concurrency&event=timerange&step=1h&tz=Asia/Kolkata", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	assert.Equal(s.T(), "time,viewers\n2021-07-30T16:00:00+05:30,1\n2021-07-30T17:00:00+05:30,1", w.Body.String())
+
+	for _, query := range []string{"tz=Mars/Olympus", "from=yesterday", "to=2021-13-01"} {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest(http.MethodGet, "/report?column=platformName&"+query, nil)
+		s.router.ServeHTTP(w, req)
+		assert.Equal(s.T(), http.StatusBadRequest, w.Code, query)
+	}
+}
+
+func (s *TestSuite) TestReportRollups() {
+	session := `{"viewerId":%d,"joinTime":"%s","leaveTime":"%s","anotherFields":[],"browserClientInfo":{"userIP":"62.152.34.188","platform":"%s","browserClient":"Chrome 92.0.4515.107","screenData_viewPort":"1440x900","screenData_resolution":"1920x1080"}}`
+	body := "[" + strings.Join([]string{
+		fmt.Sprintf(session, 21001, "2021-07-30T10:05:00Z", "2021-07-30T10:15:00Z", "Linux x86_64"),
+		fmt.Sprintf(session, 21001, "2021-07-30T12:10:00Z", "2021-07-30T12:20:00Z", "Linux x86_64"),
+		fmt.Sprintf(session, 21002, "2021-07-30T10:20:00Z", "2021-07-30T10:30:00Z", "Linux x86_64"),
+		fmt.Sprintf(session, 21003, "2021-07-30T12:30:00Z", "2021-07-30T12:40:00Z", "Windows 10 64-bit"),
+	}, ",") + "]"
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/events/rollup/collect", strings.NewReader(body))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+
+	report := func(query string) string {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/report?column=platformName&event=rollup"+query, nil)
+		s.router.ServeHTTP(w, req)
+		assert.Equal(s.T(), http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+	assert.Equal(s.T(), "platformName,count,viewers\nLinux x86_64,3,2\nWindows,1,1", report(""))
+
+	assert.NoError(s.T(), s.stat.RefreshRollups())
+	var pending int
+	err := s.stat.conn.QueryRow(`SELECT count(*) FROM "rollups_pending" WHERE "eventId" = 'rollup'`).Scan(&pending)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), 0, pending)
+	var sessions, viewers int
+	err = s.stat.conn.QueryRow(`SELECT "sessions", "viewers" FROM "rollups_hourly" WHERE "eventId" = 'rollup' AND "dimension" = 'platformName' AND "value" = 'Linux x86_64' AND "bucket" = '2021-07-30T12:00:00Z'`).Scan(&sessions, &viewers)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), 1, sessions)
+	assert.Equal(s.T(), 0, viewers)
+
+	assert.Equal(s.T(), "platformName,count,viewers\nLinux x86_64,3,2\nWindows,1,1", report(""))
+	assert.Equal(s.T(), "platformName,count,viewers\nLinux x86_64,2,2", report("&to=2021-07-30T12:00:00Z"))
+	assert.Equal(s.T(), "platformName,count,viewers\nLinux x86_64,1,1\nWindows,1,1", report("&from=2021-07-30T12:00:00Z"))
+
+	// reports read the rollups until new sessions make them stale
+	_, err = s.stat.conn.Exec(`UPDATE "rollups_daily" SET "sessions" = "sessions" + 100 WHERE "eventId" = 'rollup' AND "value" = 'Windows'`)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), "platformName,count,viewers\nLinux x86_64,3,2\nWindows,101,1", report(""))
+
+	body = "[" + fmt.Sprintf(session, 21004, "2021-07-30T09:00:00Z", "2021-07-30T09:10:00Z", "Windows 10 64-bit") + "]"
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/events/rollup/collect", strings.NewReader(body))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	assert.Equal(s.T(), "platformName,count,viewers\nLinux x86_64,3,2\nWindows,2,2", report(""))
+
+	assert.NoError(s.T(), s.stat.RefreshRollups())
+	assert.Equal(s.T(), "platformName,count,viewers\nLinux x86_64,3,2\nWindows,2,2", report(""))
+
+	// a refresh of the next day only reads the new sessions and the earlier
+	// sessions of their viewers, who are not counted again
+	body = "[" + fmt.Sprintf(session, 21001, "2021-07-31T08:00:00Z", "2021-07-31T08:10:00Z", "Linux x86_64") + "]"
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/events/rollup/collect", strings.NewReader(body))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	assert.NoError(s.T(), s.stat.RefreshRollups())
+	err = s.stat.conn.QueryRow(`SELECT "sessions", "viewers" FROM "rollups_daily" WHERE "eventId" = 'rollup' AND "dimension" = 'platformName' AND "value" = 'Linux x86_64' AND "bucket" = '2021-07-31T00:00:00Z'`).Scan(&sessions, &viewers)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), 1, sessions)
+	assert.Equal(s.T(), 0, viewers)
+	assert.Equal(s.T(), "platformName,count,viewers\nLinux x86_64,4,2\nWindows,2,2", report(""))
+
+	// while sessions are pending the earlier buckets still come from the
+	// rollups and only the sessions from the pending day on are read
+	_, err = s.stat.conn.Exec(`UPDATE "rollups_daily" SET "sessions" = "sessions" + 100 WHERE "eventId" = 'rollup' AND "value" = 'Linux x86_64' AND "bucket" = '2021-07-30T00:00:00Z'`)
+	assert.NoError(s.T(), err)
+	body = "[" + fmt.Sprintf(session, 21005, "2021-07-31T09:00:00Z", "2021-07-31T09:10:00Z", "Linux x86_64") + "]"
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/events/rollup/collect", strings.NewReader(body))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	assert.Equal(s.T(), "platformName,count,viewers\nLinux x86_64,105,3\nWindows,2,2", report(""))
+	assert.Equal(s.T(), "platformName,count,viewers\nLinux x86_64,4,2\nWindows,2,2", report("&to=2021-07-31T09:00:00Z"))
+	assert.Equal(s.T(), "platformName,count,viewers\nLinux x86_64,5,3\nWindows,2,2", report("&to=2021-07-31T10:00:00Z"))
+	_, err = s.stat.conn.Exec(`UPDATE "rollups_daily" SET "sessions" = "sessions" - 100 WHERE "eventId" = 'rollup' AND "value" = 'Linux x86_64' AND "bucket" = '2021-07-30T00:00:00Z'`)
+	assert.NoError(s.T(), err)
+}
+
+func (s *TestSuite) TestPurge() {
+	session := `{"viewerId":%d,"joinTime":"%s","leaveTime":"%s","anotherFields":[],"browserClientInfo":{"userIP":"62.152.34.188","platform":"Linux x86_64","browserClient":"Chrome 92.0.4515.107","screenData_viewPort":"1440x900","screenData_resolution":"1920x1080"}}`
+	body := "[" + strings.Join([]string{
+		fmt.Sprintf(session, 22001, "2021-07-30T10:05:00Z", "2021-07-30T10:15:00Z"),
+		fmt.Sprintf(session, 22002, "2021-07-30T12:10:00Z", "2021-07-30T12:20:00Z"),
+	}, ",") + "]"
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/events/purge/collect", strings.NewReader(body))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	assert.NoError(s.T(), s.stat.RefreshRollups())
+
+	purged, err := s.stat.Purge("purge", time.Date(2021, 7, 30, 11, 0, 0, 0, time.UTC))
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(1), purged)
+
+	var viewers, pending int
+	err = s.stat.conn.QueryRow(`SELECT count(*) FROM "viewers" WHERE "viewerId" = 22001`).Scan(&viewers)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), 0, viewers)
+	err = s.stat.conn.QueryRow(`SELECT count(*) FROM "rollups_pending" WHERE "eventId" = 'purge'`).Scan(&pending)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), 1, pending)
+
+	// the report command refreshes the rollups before it reads them
+	var report bytes.Buffer
+	err = reportCommand(s.stat, []string{"column=platformName&event=purge", "format=json"}, &report)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), `[{"platformName":"Linux x86_64","count":1,"viewers":1}]`, report.String())
+	err = s.stat.conn.QueryRow(`SELECT count(*) FROM "rollups_pending" WHERE "eventId" = 'purge'`).Scan(&pending)
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), 0, pending)
+}
+
+func (s *TestSuite) TestJSONSource() {
+	source, err := NewJSONSource(strings.NewReader(`[{"viewerId":23001}, {"viewerId":"23002"}, {"viewerId":23003}]`))
+	assert.NoError(s.T(), err)
+	viewer, line, err := source.Next()
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), int32(23001), viewer.ViewerId)
+	assert.Equal(s.T(), 1, line)
+	_, _, err = source.Next()
+	var lineErr *LineError
+	assert.ErrorAs(s.T(), err, &lineErr)
+	assert.Equal(s.T(), 2, lineErr.Line)
+	viewer, line, err = source.Next()
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), int32(23003), viewer.ViewerId)
+	assert.Equal(s.T(), 3, line)
+	_, _, err = source.Next()
+	assert.Equal(s.T(), io.EOF, err)
+}
+
+func (s *TestSuite) TestBackup() {
+	if s.stat.storage.Name() != "sqlite3" {
+		s.T().Skip("backups of other databases need their dump tools")
+	}
+	path := filepath.Join(s.T().TempDir(), "backup.db")
+	assert.NoError(s.T(), s.stat.storage.Backup(path))
+
+	backup, err := NewSQLiteStorage(path)
+	assert.NoError(s.T(), err)
+	var stored, backedUp int
+	assert.NoError(s.T(), s.stat.conn.QueryRow(`SELECT count(*) FROM "stats"`).Scan(&stored))
+	assert.NoError(s.T(), backup.DB().QueryRow(`SELECT count(*) FROM "stats"`).Scan(&backedUp))
+	assert.Equal(s.T(), stored, backedUp)
+	assert.NoError(s.T(), backup.DB().Close())
+}
+
+func (s *TestSuite) TestConfig() {
+	dir := s.T().TempDir()
+	files := map[string]string{
+		"stat.yaml": "listen: \":8080\"\nstorage:\n  dsn: postgres://stat@localhost/stat\ngeo:\n  backend: none\n  cacheTTL: 1h\nretention:\n  maxAge: 720h\n",
+		"stat.toml": "listen = \":8080\"\n[storage]\ndsn = \"postgres://stat@localhost/stat\"\n[geo]\nbackend = \"none\"\ncacheTTL = \"1h\"\n[retention]\nmaxAge = \"720h\"\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		assert.NoError(s.T(), os.WriteFile(path, []byte(content), 0644))
+		config := DefaultConfig()
+		assert.NoError(s.T(), config.Load(path), name)
+		assert.Equal(s.T(), ":8080", config.Listen, name)
+		assert.Equal(s.T(), "postgres://stat@localhost/stat", config.Storage.DSN, name)
+		assert.Equal(s.T(), "none", config.Geo.Backend, name)
+		assert.Equal(s.T(), time.Hour, config.Geo.CacheTTL.Duration, name)
+		assert.Equal(s.T(), defaultGeoWorkers, config.Geo.Workers, name)
+		assert.Equal(s.T(), 720*time.Hour, config.Retention.MaxAge.Duration, name)
+		assert.NoError(s.T(), config.Validate(), name)
+	}
+
+	path := filepath.Join(dir, "unknown.yaml")
+	assert.NoError(s.T(), os.WriteFile(path, []byte("listn: \":8080\"\n"), 0644))
+	assert.Error(s.T(), DefaultConfig().Load(path))
+
+	env := map[string]string{"STAT_LISTEN": ":9090", "STAT_GEO_WORKERS": "0", "STAT_GEO_TIMEOUT": "5s", "STAT_LOG_REQUESTS": "false"}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+	config := DefaultConfig()
+	assert.NoError(s.T(), config.LoadEnv(lookup))
+	assert.Equal(s.T(), ":9090", config.Listen)
+	assert.Equal(s.T(), 5*time.Second, config.Geo.Timeout.Duration)
+	assert.False(s.T(), config.Logging.Requests)
+	assert.EqualError(s.T(), config.Validate(), "invalid configuration: geo workers must be at least 1")
+
+	env["STAT_GEO_TIMEOUT"] = "soon"
+	assert.Error(s.T(), DefaultConfig().LoadEnv(lookup))
+}
+
+func (s *TestSuite) TestRebind() {
+	query, order := rebind(`SELECT "joinTime", '$1' FROM stats WHERE "eventId" = $2 AND "viewerId" = $1 UNION ALL SELECT "leaveTime", '$1' FROM stats WHERE "eventId" = $2`)
+	assert.Equal(s.T(), `SELECT "joinTime", '$1' FROM stats WHERE "eventId" = ? AND "viewerId" = ? UNION ALL SELECT "leaveTime", '$1' FROM stats WHERE "eventId" = ?`, query)
+	assert.Equal(s.T(), []int{1, 0, 1}, order)
+
+	query, order = rebind(`SELECT GET_LOCK(?, 10)`)
+	assert.Equal(s.T(), `SELECT GET_LOCK(?, 10)`, query)
+	assert.Nil(s.T(), order)
+}
+
+func (s *TestSuite) TestReportRetention() {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/events", strings.NewReader(`{"eventId":"retention","title":"Retention","scheduledStart":"2021-07-30T14:00:00+03:00"}`))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+
+	// the first viewer reconnects at 14:03, the second one leaves at 14:02
+	body := `[{"viewerId":90101,"joinTime":"2021-07-30T14:00:00+03:00","leaveTime":"2021-07-30T14:03:00+03:00"},{"viewerId":90101,"joinTime":"2021-07-30T14:03:00+03:00","leaveTime":"2021-07-30T14:04:00+03:00"},{"viewerId":90102,"joinTime":"2021-07-30T14:01:00+03:00","leaveTime":"2021-07-30T14:02:00+03:00"}]`
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/events/retention/collect", strings.NewReader(body))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=retention&event=retention", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	assert.Equal(s.T(), "minute,joined,watching,retention\n0,1,1,100\n1,2,2,100\n2,2,1,50\n3,2,1,50\n4,2,0,0", w.Body.String())
+}
+
+func (s *TestSuite) TestReportEngagement() {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/events", strings.NewReader(`{"eventId":"engagement","title":"Engagement","scheduledStart":"2021-07-30T14:00:00+03:00","scheduledEnd":"2021-07-30T15:00:00+03:00"}`))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+
+	body := `[{"viewerId":90201,"name":"Роман","lastName":"XXXXX","email":"aaaa@pikemedia.ru","joinTime":"2021-07-30T14:00:00+03:00","leaveTime":"2021-07-30T15:00:00+03:00","chatCommentsTotal":4},{"viewerId":90202,"name":"Сергей","lastName":"Сергеев","email":"bbbbb@pikemedia.ru","joinTime":"2021-07-30T14:00:00+03:00","leaveTime":"2021-07-30T14:30:00+03:00","chatCommentsTotal":2}]`
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/events/engagement/collect", strings.NewReader(body))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=engagement&event=engagement&moments=2021-07-30T14:45:00%2B03:00", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	assert.Equal(s.T(), "eventId,viewerId,name,lastName,email,watched,chatComments,moments,score\nengagement,90201,Роман,XXXXX,aaaa@pikemedia.ru,3600,4,1,100\nengagement,90202,Сергей,Сергеев,bbbbb@pikemedia.ru,1800,2,0,45", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=engagement&event=engagement&watchWeight=1&chatWeight=0", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Contains(s.T(), w.Body.String(), ",1800,2,0,50")
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=engagementHistogram&event=engagement&bins=4&moments=2021-07-30T14:45:00%2B03:00", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), "from,to,viewers\n0,25,0\n25,50,1\n50,75,0\n75,100,1", w.Body.String())
+
+	// nobody commented, so the chat weight must not cap the scores
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/events", strings.NewReader(`{"eventId":"engagement-silent","title":"Silent","scheduledStart":"2021-07-30T14:00:00+03:00","scheduledEnd":"2021-07-30T15:00:00+03:00"}`))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+
+	// the session of the third viewer is cut short, the reported spentTime counts
+	body = `[{"viewerId":90211,"name":"Роман","lastName":"XXXXX","email":"aaaa@pikemedia.ru","joinTime":"2021-07-30T14:00:00+03:00","leaveTime":"2021-07-30T15:00:00+03:00","chatCommentsTotal":0},{"viewerId":90212,"name":"Сергей","lastName":"Сергеев","email":"bbbbb@pikemedia.ru","joinTime":"2021-07-30T14:00:00+03:00","leaveTime":"2021-07-30T14:30:00+03:00","chatCommentsTotal":0},{"viewerId":90213,"name":"Анна","lastName":"Андреева","email":"ccccc@pikemedia.ru","joinTime":"2021-07-30T14:00:00+03:00","leaveTime":"2021-07-30T14:10:00+03:00","spentTime":1800000000000,"chatCommentsTotal":0}]`
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/events/engagement-silent/collect", strings.NewReader(body))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=engagement&event=engagement-silent", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), "eventId,viewerId,name,lastName,email,watched,chatComments,moments,score\nengagement-silent,90211,Роман,XXXXX,aaaa@pikemedia.ru,3600,0,0,100\nengagement-silent,90212,Сергей,Сергеев,bbbbb@pikemedia.ru,1800,0,0,50\nengagement-silent,90213,Анна,Андреева,ccccc@pikemedia.ru,1800,0,0,50", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=engagementEvents&event=engagement-silent", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	assert.Equal(s.T(), "eventId,viewers,mean,median,hot\nengagement-silent,3,66.67,50,1", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=engagementEvents&event=engagement-silent&hot=50", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), "eventId,viewers,mean,median,hot\nengagement-silent,3,66.67,50,3", w.Body.String())
+
+	// both watched the whole event and commented as much, the delta percents break the tie
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/events", strings.NewReader(`{"eventId":"engagement-trend","title":"Trend","scheduledStart":"2021-07-30T14:00:00+03:00","scheduledEnd":"2021-07-30T15:00:00+03:00"}`))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+
+	body = `[{"viewerId":90221,"name":"Роман","joinTime":"2021-07-30T14:00:00+03:00","leaveTime":"2021-07-30T15:00:00+03:00","spentTimeDeltaPercent":50,"chatCommentsTotal":2,"chatCommentsDeltaPercent":20},{"viewerId":90222,"name":"Сергей","joinTime":"2021-07-30T14:00:00+03:00","leaveTime":"2021-07-30T15:00:00+03:00","spentTimeDeltaPercent":0,"chatCommentsTotal":2,"chatCommentsDeltaPercent":40}]`
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/events/engagement-trend/collect", strings.NewReader(body))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=engagement&event=engagement-trend", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), "eventId,viewerId,name,lastName,email,watched,chatComments,moments,score\nengagement-trend,90221,Роман,,,3600,2,0,95.83\nengagement-trend,90222,Сергей,,,3600,2,0,83.33", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=engagement&event=engagement-trend&trendWeight=0", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Contains(s.T(), w.Body.String(), "engagement-trend,90221,Роман,,,3600,2,0,100\nengagement-trend,90222,Сергей,,,3600,2,0,100")
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=engagement&event=engagement-trend&trendWeight=2", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusBadRequest, w.Code)
+}
+
+func (s *TestSuite) TestReportAttendance() {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/events", strings.NewReader(`{"eventId":"attendance","title":"Attendance","scheduledStart":"2021-07-30T14:00:00+03:00","scheduledEnd":"2021-07-30T15:00:00+03:00"}`))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+
+	// the first viewer reconnects with overlapping sessions and watches 50 minutes in total,
+	// the third one joins early and stays late but only the scheduled hour counts
+	body := `[{"viewerId":90301,"name":"Роман","lastName":"XXXXX","email":"aaaa@pikemedia.ru","joinTime":"2021-07-30T14:00:00+03:00","leaveTime":"2021-07-30T14:30:00+03:00"},{"viewerId":90301,"name":"Роман","lastName":"XXXXX","email":"aaaa@pikemedia.ru","joinTime":"2021-07-30T14:20:00+03:00","leaveTime":"2021-07-30T14:50:00+03:00"},{"viewerId":90302,"name":"Сергей","lastName":"Сергеев","email":"bbbbb@pikemedia.ru","joinTime":"2021-07-30T14:00:00+03:00","leaveTime":"2021-07-30T14:25:00+03:00"},{"viewerId":90303,"name":"Анна","lastName":"Андреева","email":"ccccc@pikemedia.ru","joinTime":"2021-07-30T13:30:00+03:00","leaveTime":"2021-07-30T15:30:00+03:00"}]`
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/events/attendance/collect", strings.NewReader(body))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=attendance&event=attendance&minPercent=80", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	assert.Equal(s.T(), "viewerId,name,lastName,email,watched,percent\n90301,Роман,XXXXX,aaaa@pikemedia.ru,3000,83.33\n90303,Анна,Андреева,ccccc@pikemedia.ru,3600,100", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=attendance&event=attendance&minMinutes=20", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), "viewerId,name,lastName,email,watched,percent\n90301,Роман,XXXXX,aaaa@pikemedia.ru,3000,83.33\n90303,Анна,Андреева,ccccc@pikemedia.ru,3600,100\n90302,Сергей,Сергеев,bbbbb@pikemedia.ru,1500,41.67", w.Body.String())
+
+	// minPercent needs a schedule
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=attendance&event=unscheduled&minPercent=80", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=attendance&event=attendance&minMinutes=20&format=signed", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusInternalServerError, w.Code)
+
+	s.stat.SetSigningKey([]byte("secret"))
+	defer s.stat.SetSigningKey(nil)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?column=attendance&event=attendance&minMinutes=20&format=signed", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	var signed SignedAttendance
+	assert.NoError(s.T(), json.Unmarshal(w.Body.Bytes(), &signed))
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(signed.Payload)
+	assert.Equal(s.T(), hex.EncodeToString(mac.Sum(nil)), signed.Signature)
+	var attendance Attendance
+	assert.NoError(s.T(), json.Unmarshal(signed.Payload, &attendance))
+	assert.Len(s.T(), attendance.Attendees, 3)
+	assert.Equal(s.T(), float64(3600), attendance.Attendees[1].Watched)
+}
+
+func (s *TestSuite) TestReportQuery() {
+	body := `[{"viewerId":90401,"email":"a@Pikemedia.ru","joinTime":"2021-07-30T14:00:00+03:00","leaveTime":"2021-07-30T14:10:00+03:00","spentTime":600000000000,"chatCommentsTotal":2,"browserClientInfo":{"platform":"Windows 10 64-bit","browserClient":"Chrome 92.0.4515.107","screenData_resolution":"1920x1080"}},{"viewerId":90402,"email":"b@pikemedia.ru","joinTime":"2021-07-30T14:00:00+03:00","leaveTime":"2021-07-30T14:20:00+03:00","spentTime":1200000000000,"chatCommentsTotal":1,"browserClientInfo":{"platform":"Windows 10 64-bit","browserClient":"Firefox 90.0","screenData_resolution":"1920x1080"}},{"viewerId":90402,"email":"b@pikemedia.ru","joinTime":"2021-07-30T15:00:00+03:00","leaveTime":"2021-07-30T15:30:00+03:00","spentTime":1800000000000,"chatCommentsTotal":1,"browserClientInfo":{"platform":"Windows 10 64-bit","browserClient":"Firefox 90.0","screenData_resolution":"1920x1080"}},{"viewerId":90403,"email":"c@example.com","joinTime":"2021-07-30T14:05:00+03:00","leaveTime":"2021-07-30T14:10:00+03:00","spentTime":300000000000,"browserClientInfo":{"platform":"OS X 10.15.7 64-bit","browserClient":"Safari 14.1","screenData_resolution":"1440x900"}}]`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/events/query/collect", strings.NewReader(body))
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?event=query&dimensions=platformName,emailDomain&metrics=count,uniqueViewers,avgSpentTime,medianSpentTime,p95SpentTime,sumChatComments", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	assert.Equal(s.T(), "platformName,emailDomain,count,uniqueViewers,avgSpentTime,medianSpentTime,p95SpentTime,sumChatComments\nWindows,pikemedia.ru,3,2,1200,1200,1800,4\nOS X,example.com,1,1,300,300,300,0", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/report?event=query&dimensions=resolution&filter[browserClientName]=Firefox&to=2021-07-30T14:30:00%2B03:00&format=json", nil)
+	s.router.ServeHTTP(w, req)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	assert.Equal(s.T(), `[{"resolution":"1920x1080","count":1}]`, w.Body.String())
+
+	for _, query := range []string{"dimensions=password", "dimensions=platformName&metrics=max(email)", "dimensions=platformName&filter[email]=a"} {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest(http.MethodGet, "/report?"+query, nil)
+		s.router.ServeHTTP(w, req)
+		assert.Equal(s.T(), http.StatusBadRequest, w.Code, query)
+	}
+}
+
+func (s *TestSuite) TestAuth() {
+	s.stat.SetAuthRequired(true)
+	defer s.stat.SetAuthRequired(false)
+	request := func(method string, target string, key string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, target, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		s.router.ServeHTTP(w, req)
+		return w
+	}
+
+	admin, err := s.stat.CreateAPIKey("admin", "", []string{ScopeAdmin})
+	assert.NoError(s.T(), err)
+	assert.Equal(s.T(), http.StatusOK, request(http.MethodGet, "/ping", "", "").Code)
+	assert.Equal(s.T(), http.StatusUnauthorized, request(http.MethodGet, "/stat", "", "").Code)
+	assert.Equal(s.T(), http.StatusUnauthorized, request(http.MethodGet, "/stat", admin.KeyId+".wrong", "").Code)
+	assert.Equal(s.T(), http.StatusForbidden, request(http.MethodGet, "/stat", admin.Key, "").Code)
+
+	// keys of two tenants, the secret is only returned on creation
+	keys := make(map[string]APIKey)
+	for _, tenant := range []string{"acme", "globex"} {
+		w := request(http.MethodPost, "/admin/keys", admin.Key, `{"name":"`+tenant+`","tenant":"`+tenant+`","scopes":["collect","report"]}`)
+		assert.Equal(s.T(), http.StatusOK, w.Code)
+		var key APIKey
+		assert.NoError(s.T(), json.Unmarshal(w.Body.Bytes(), &key))
+		assert.NotEmpty(s.T(), key.Key)
+		keys[tenant] = key
+	}
+	assert.Equal(s.T(), http.StatusBadRequest, request(http.MethodPost, "/admin/keys", admin.Key, `{"scopes":["everything"]}`).Code)
+	assert.Equal(s.T(), http.StatusForbidden, request(http.MethodGet, "/admin/keys", keys["acme"].Key, "").Code)
+	var listed []APIKey
+	w := request(http.MethodGet, "/admin/keys", admin.Key, "")
+	assert.NoError(s.T(), json.Unmarshal(w.Body.Bytes(), &listed))
+	for _, key := range listed {
+		assert.Empty(s.T(), key.Key)
+	}
+
+	body := `[{"eventId":"tenant-acme","viewerId":120001,"name":"Роман","lastName":"XXXXX","email":"aaaa@pikemedia.ru","joinTime":"2021-07-30T14:05:00+03:00","leaveTime":"2021-07-30T15:00:00+03:00","spentTime":3300000000000,"browserClientInfo":{"userIP":"62.152.34.188","platform":"Linux x86_64","browserClient":"Chrome 92.0.4515.107","screenData_viewPort":"1440x900","screenData_resolution":"1440x900"}}]`
+	w = request(http.MethodPost, "/collect", keys["acme"].Key, body)
+	assert.Equal(s.T(), http.StatusOK, w.Code)
+	assert.Contains(s.T(), w.Body.String(), `"result":"success"`)
+
+	// the event belongs to acme now
+	w = request(http.MethodPost, "/collect", keys["globex"].Key, strings.ReplaceAll(body, "120001", "120002"))
+	assert.Contains(s.T(), w.Body.String(), `"result":"failed"`)
+	assert.Contains(s.T(), w.Body.String(), ErrForbidden.Error())
+	assert.Equal(s.T(), http.StatusForbidden, request(http.MethodPost, "/events", keys["globex"].Key, `{"eventId":"tenant-acme","title":"Globex"}`).Code)
+	assert.Equal(s.T(), http.StatusForbidden, request(http.MethodPost, "/heartbeat", keys["globex"].Key, `{"eventId":"tenant-acme","viewerId":120002}`).Code)
+	assert.Equal(s.T(), http.StatusOK, request(http.MethodPost, "/events", keys["acme"].Key, `{"eventId":"tenant-acme","title":"Acme"}`).Code)
+
+	// the schedule of another tenant's event cannot be told from an unknown event
+	assert.Equal(s.T(), http.StatusOK, request(http.MethodPost, "/events", keys["acme"].Key, `{"eventId":"tenant-acme-scheduled","title":"Acme","scheduledStart":"2021-07-30T14:00:00+03:00","scheduledEnd":"2021-07-30T15:00:00+03:00"}`).Code)
+	assert.Equal(s.T(), http.StatusOK, request(http.MethodGet, "/report?column=attendance&event=tenant-acme-scheduled&minPercent=50", keys["acme"].Key, "").Code)
+	assert.Equal(s.T(), http.StatusBadRequest, request(http.MethodGet, "/report?column=attendance&event=tenant-acme-scheduled&minPercent=50", keys["globex"].Key, "").Code)
+	assert.Equal(s.T(), http.StatusBadRequest, request(http.MethodGet, "/report?column=attendance&event=tenant-unknown&minPercent=50", keys["globex"].Key, "").Code)
+	_, ok := s.stat.eventStart("tenant-acme-scheduled", "acme")
+	assert.True(s.T(), ok)
+	_, ok = s.stat.eventStart("tenant-acme-scheduled", "globex")
+	assert.False(s.T(), ok)
+
+	// the same viewer id at another tenant has a profile of its own
+	other := strings.NewReplacer("tenant-acme", "tenant-globex", "aaaa@pikemedia.ru", "mallory@example.com").Replace(body)
+	w = request(http.MethodPost, "/collect?conflict=merge", keys["globex"].Key, other)
+	assert.Contains(s.T(), w.Body.String(), `"result":"success"`)
+	w = request(http.MethodGet, "/report?column=engagement&event=tenant-acme&format=json", keys["acme"].Key, "")
+	assert.Contains(s.T(), w.Body.String(), "aaaa@pikemedia.ru")
+	assert.NotContains(s.T(), w.Body.String(), "mallory@example.com")
+	w = request(http.MethodGet, "/report?column=engagement&event=tenant-globex&format=json", keys["globex"].Key, "")
+	assert.Contains(s.T(), w.Body.String(), "mallory@example.com")
+
+	w = request(http.MethodGet, "/report?column=platformName&event=tenant-acme", keys["acme"].Key, "")
+	assert.Equal(s.T(), "platformName,count,viewers\nLinux x86_64,1,1", w.Body.String())
+	w = request(http.MethodGet, "/report?column=platformName&event=tenant-acme", keys["globex"].Key, "")
+	assert.Equal(s.T(), "platformName,count,viewers", w.Body.String())
+	w = request(http.MethodGet, "/stat", keys["globex"].Key, "")
+	assert.Contains(s.T(), w.Body.String(), `"count":1`)
+	w = request(http.MethodGet, "/events", keys["globex"].Key, "")
+	assert.NotContains(s.T(), w.Body.String(), "tenant-acme")
+	assert.Equal(s.T(), http.StatusOK, request(http.MethodGet, "/events/tenant-acme", keys["acme"].Key, "").Code)
+	assert.Equal(s.T(), http.StatusNotFound, request(http.MethodGet, "/events/tenant-acme", keys["globex"].Key, "").Code)
+	assert.Equal(s.T(), http.StatusNotFound, request(http.MethodGet, "/events/tenant-acme/live", keys["globex"].Key, "").Code)
+
+	// revoked keys are rejected
+	assert.Equal(s.T(), http.StatusOK, request(http.MethodDelete, "/admin/keys/"+keys["globex"].KeyId, admin.Key, "").Code)
+	assert.Equal(s.T(), http.StatusNotFound, request(http.MethodDelete, "/admin/keys/"+keys["globex"].KeyId, admin.Key, "").Code)
+	assert.Equal(s.T(), http.StatusUnauthorized, request(http.MethodGet, "/stat", keys["globex"].Key, "").Code)
+	req, _ := http.NewRequest(http.MethodGet, "/stat", nil)
+	req.Header.Set("X-API-Key", keys["acme"].Key)
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	assert.Contains(s.T(), w.Body.String(), `"count":1`)
 }
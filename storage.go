@@ -0,0 +1,220 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/golang-migrate/migrate/v4/database"
+	"github.com/golang-migrate/migrate/v4/database/pgx"
+	"github.com/golang-migrate/migrate/v4/database/sqlite3"
+	_ "github.com/jackc/pgx/v4/stdlib"
+	_ "github.com/mattn/go-sqlite3"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const defaultDSN = "./db/stats.db"
+
+// Storage is the database the statistics are kept in. Queries are written in
+// the SQL shared by the supported databases; a storage supplies the connection,
+// its migrations and the few expressions that differ.
+type Storage interface {
+	// Name selects the migrations under db/migrations.
+	Name() string
+	DB() *sql.DB
+	// MigrationDriver wraps the connection for golang-migrate.
+	MigrationDriver() (database.Driver, error)
+	// Position returns an expression for the 1-based position of substr in str, 0 if it is missing.
+	Position(str string, substr string) string
+	// OnConflict starts the update of an INSERT whose row conflicts on the
+	// unique columns and has to follow its VALUES list directly. Excluded
+	// refers to a value the INSERT tried to store.
+	OnConflict(columns ...string) string
+	Excluded(column string) string
+	// Backup writes a copy of the database to a new file.
+	Backup(path string) error
+}
+
+type SQLiteStorage struct {
+	db *sql.DB
+}
+
+func NewSQLiteStorage(dsn string) (*SQLiteStorage, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLiteStorage{db: db}, nil
+}
+
+func (storage *SQLiteStorage) Name() string {
+	return "sqlite3"
+}
+
+func (storage *SQLiteStorage) DB() *sql.DB {
+	return storage.db
+}
+
+func (storage *SQLiteStorage) MigrationDriver() (database.Driver, error) {
+	return sqlite3.WithInstance(storage.db, &sqlite3.Config{})
+}
+
+func (storage *SQLiteStorage) Position(str string, substr string) string {
+	return "instr(" + str + ", " + substr + ")"
+}
+
+func (storage *SQLiteStorage) OnConflict(columns ...string) string {
+	return onConflict(columns)
+}
+
+func (storage *SQLiteStorage) Excluded(column string) string {
+	return `excluded."` + column + `"`
+}
+
+// Backup writes a consistent copy that opens as a SQLite database.
+func (storage *SQLiteStorage) Backup(path string) error {
+	_, err := storage.db.Exec(`VACUUM INTO $1`, path)
+	return err
+}
+
+// PostgresStorage keeps the statistics in PostgreSQL 9.5 or later, the first
+// version with ON CONFLICT.
+type PostgresStorage struct {
+	db  *sql.DB
+	dsn string
+}
+
+func NewPostgresStorage(dsn string) (*PostgresStorage, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresStorage{db: db, dsn: dsn}, nil
+}
+
+func (storage *PostgresStorage) Name() string {
+	return "postgres"
+}
+
+func (storage *PostgresStorage) DB() *sql.DB {
+	return storage.db
+}
+
+func (storage *PostgresStorage) MigrationDriver() (database.Driver, error) {
+	return pgx.WithInstance(storage.db, &pgx.Config{})
+}
+
+func (storage *PostgresStorage) Position(str string, substr string) string {
+	return "strpos(" + str + ", " + substr + ")"
+}
+
+func (storage *PostgresStorage) OnConflict(columns ...string) string {
+	return onConflict(columns)
+}
+
+func (storage *PostgresStorage) Excluded(column string) string {
+	return `excluded."` + column + `"`
+}
+
+// Backup runs pg_dump, which has to be installed, and writes a dump in its
+// custom format for pg_restore.
+func (storage *PostgresStorage) Backup(path string) error {
+	args, password, err := pgDumpArgs(storage.dsn, path)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("pg_dump", args...)
+	// the password is kept off the command line
+	cmd.Env = os.Environ()
+	if password != "" {
+		cmd.Env = append(cmd.Env, "PGPASSWORD="+password)
+	}
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// pgDumpArgs splits a postgres:// URL into the pg_dump arguments and the
+// password. Parameters such as sslmode stay in the connection URI passed as
+// --dbname.
+func pgDumpArgs(dsn string, path string) ([]string, string, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, "", err
+	}
+	args := []string{"--format=custom", "--file=" + path}
+	if u.Hostname() != "" {
+		args = append(args, "--host="+u.Hostname())
+	}
+	if u.Port() != "" {
+		args = append(args, "--port="+u.Port())
+	}
+	if u.User.Username() != "" {
+		args = append(args, "--username="+u.User.Username())
+	}
+	password, _ := u.User.Password()
+	query := u.Query()
+	if query.Has("password") {
+		password = query.Get("password")
+		query.Del("password")
+	}
+	dbname := url.URL{Scheme: "postgresql", Path: "/" + strings.TrimPrefix(u.Path, "/"), RawQuery: query.Encode()}
+	return append(args, "--dbname="+dbname.String()), password, nil
+}
+
+// onConflict is the upsert clause shared by SQLite and PostgreSQL.
+func onConflict(columns []string) string {
+	return `ON CONFLICT("` + strings.Join(columns, `","`) + `") DO UPDATE SET`
+}
+
+// dsnScheme returns the database a DSN selects: postgres:// and postgresql://
+// URLs select PostgreSQL; mysql:// followed by a go-sql-driver DSN selects MySQL
+// or MariaDB; sqlite3:// URLs, file: URIs and plain paths select SQLite.
+func dsnScheme(dsn string) (string, error) {
+	if dsn == "" {
+		return "", errors.New("database DSN is empty")
+	}
+	scheme := ""
+	if i := strings.Index(dsn, "://"); i >= 0 {
+		scheme = dsn[:i]
+	}
+	switch scheme {
+	case "postgres", "postgresql":
+		return "postgres", nil
+	case "mysql":
+		return "mysql", nil
+	case "sqlite3", "":
+		return "sqlite3", nil
+	default:
+		return "", fmt.Errorf("unsupported database %q", scheme)
+	}
+}
+
+// NewStorage opens the database a DSN points to.
+func NewStorage(dsn string) (Storage, error) {
+	scheme, err := dsnScheme(dsn)
+	if err != nil {
+		return nil, err
+	}
+	switch scheme {
+	case "postgres":
+		storage, err := NewPostgresStorage(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return storage, nil
+	case "mysql":
+		storage, err := NewMySQLStorage(strings.TrimPrefix(dsn, "mysql://"))
+		if err != nil {
+			return nil, err
+		}
+		return storage, nil
+	default:
+		storage, err := NewSQLiteStorage(strings.TrimPrefix(dsn, "sqlite3://"))
+		if err != nil {
+			return nil, err
+		}
+		return storage, nil
+	}
+}
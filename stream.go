@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultStreamBatch = 500
+	maxStreamBatch     = 10000
+	maxStreamErrors    = 100
+)
+
+// LineError rejects a single line of the input without aborting the rest of it.
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return "line " + strconv.Itoa(e.Line) + ": " + e.Err.Error()
+}
+
+// ViewerSource yields decoded viewers with their line numbers. Next returns a
+// *LineError for a malformed line, io.EOF at the end of the input and any other
+// error when the input can not be read any further.
+type ViewerSource interface {
+	Next() (Viewer, int, error)
+}
+
+type ndjsonSource struct {
+	reader *bufio.Reader
+	line   int
+}
+
+func NewNDJSONSource(r io.Reader) ViewerSource {
+	return &ndjsonSource{reader: bufio.NewReader(r)}
+}
+
+func (source *ndjsonSource) Next() (Viewer, int, error) {
+	for {
+		data, err := source.reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return Viewer{}, source.line + 1, err
+		}
+		if len(data) == 0 && err == io.EOF {
+			return Viewer{}, source.line, io.EOF
+		}
+		source.line++
+		data = bytes.TrimSpace(data)
+		if len(data) == 0 {
+			continue
+		}
+		var viewer Viewer
+		jsonErr := json.Unmarshal(data, &viewer)
+		if jsonErr != nil {
+			return Viewer{}, source.line, &LineError{Line: source.line, Err: jsonErr}
+		}
+		return viewer, source.line, nil
+	}
+}
+
+// jsonSource reads a JSON array of viewers as sent to /collect. Viewers are
+// numbered by their position in the array.
+type jsonSource struct {
+	decoder *json.Decoder
+	line    int
+}
+
+func NewJSONSource(r io.Reader) (ViewerSource, error) {
+	decoder := json.NewDecoder(r)
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if token != json.Delim('[') {
+		return nil, errors.New("expected an array of viewers")
+	}
+	return &jsonSource{decoder: decoder}, nil
+}
+
+func (source *jsonSource) Next() (Viewer, int, error) {
+	if !source.decoder.More() {
+		return Viewer{}, source.line, io.EOF
+	}
+	source.line++
+	var viewer Viewer
+	err := source.decoder.Decode(&viewer)
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return Viewer{}, source.line, err
+	}
+	if err != nil {
+		// the value was read whole, the next one can still be decoded
+		return Viewer{}, source.line, &LineError{Line: source.line, Err: err}
+	}
+	return viewer, source.line, nil
+}
+
+type StreamError struct {
+	Line     int    `json:"line"`
+	ViewerId int32  `json:"viewerId,omitempty"`
+	Error    string `json:"error"`
+}
+
+type StreamResult struct {
+	Result   string        `json:"result"`
+	Accepted int           `json:"accepted"`
+	Rejected int           `json:"rejected"`
+	Errors   []StreamError `json:"errors"`
+}
+
+func (result *StreamResult) reject(e StreamError) {
+	result.Rejected++
+	if len(result.Errors) < maxStreamErrors {
+		result.Errors = append(result.Errors, e)
+	}
+}
+
+// streamBatch buffers decoded viewers together with their line numbers.
+type streamBatch struct {
+	viewers []Viewer
+	lines   []int
+}
+
+func (stat *Stat) flushStream(batch *streamBatch, options CollectOptions, result *StreamResult) error {
+	if len(batch.viewers) == 0 {
+		return nil
+	}
+	stat.enricher.Enrich(batch.viewers)
+	stored, err := stat.StoreViewers(batch.viewers, options)
+	if err != nil {
+		return err
+	}
+	for i, record := range stored.Records {
+		switch record.Status {
+		case RecordOk:
+			result.Accepted++
+		case RecordRolledBack:
+			result.reject(StreamError{Line: batch.lines[i], ViewerId: record.ViewerId, Error: "rolled back with its batch"})
+		default:
+			result.reject(StreamError{Line: batch.lines[i], ViewerId: record.ViewerId, Error: record.Error})
+		}
+	}
+	batch.viewers = batch.viewers[:0]
+	batch.lines = batch.lines[:0]
+	return nil
+}
+
+// Ingest reads viewers from the source and stores them in transactions of batchSize
+// records. A non-empty eventId overrides the event of every viewer.
+func (stat *Stat) Ingest(source ViewerSource, eventId string, batchSize int, options CollectOptions) (*StreamResult, error) {
+	result := &StreamResult{Errors: []StreamError{}}
+	batch := &streamBatch{}
+	for {
+		viewer, line, err := source.Next()
+		if err == io.EOF {
+			break
+		}
+		var lineErr *LineError
+		if errors.As(err, &lineErr) {
+			result.reject(StreamError{Line: lineErr.Line, Error: lineErr.Err.Error()})
+			continue
+		}
+		if err != nil {
+			result.reject(StreamError{Line: line, Error: err.Error()})
+			break
+		}
+		if eventId != "" {
+			viewer.EventId = eventId
+		}
+		batch.viewers = append(batch.viewers, viewer)
+		batch.lines = append(batch.lines, line)
+		if len(batch.viewers) >= batchSize {
+			err = stat.flushStream(batch, options, result)
+			if err != nil {
+				return result, err
+			}
+		}
+	}
+	err := stat.flushStream(batch, options, result)
+	if err != nil {
+		return result, err
+	}
+
+	switch {
+	case result.Rejected == 0:
+		result.Result = "success"
+	case result.Accepted == 0:
+		result.Result = "failed"
+	default:
+		result.Result = "partial"
+	}
+	return result, nil
+}
+
+// ingestOptions reads the collect options and the batch size of a streaming upload.
+func ingestOptions(c *gin.Context) (CollectOptions, int, error) {
+	options, err := collectOptions(c)
+	if err != nil {
+		return options, 0, err
+	}
+	if c.Query("mode") == "" {
+		// a single bad line must not reject the rest of the batch
+		options.Mode = CollectPartial
+	}
+	batch := c.DefaultQuery("batch", strconv.Itoa(defaultStreamBatch))
+	batchSize, err := strconv.Atoi(batch)
+	if err != nil || batchSize < 1 || batchSize > maxStreamBatch {
+		return options, 0, fmt.Errorf("incorrect batch %q", batch)
+	}
+	return options, batchSize, nil
+}
+
+// requestBody returns the request body, transparently decompressing gzip uploads.
+func requestBody(c *gin.Context) (io.ReadCloser, error) {
+	if c.GetHeader("Content-Encoding") == "gzip" {
+		return gzip.NewReader(c.Request.Body)
+	}
+	return c.Request.Body, nil
+}
+
+func (stat *Stat) ingestRequest(c *gin.Context, newSource func(r io.Reader) (ViewerSource, error)) {
+	options, batchSize, err := ingestOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"result": "failed", "error": err.Error()})
+		return
+	}
+
+	body, err := requestBody(c)
+	if err != nil {
+		log.Printf("Ingest failed: %v\n", err)
+		c.JSON(http.StatusBadRequest, gin.H{"result": "failed"})
+		return
+	}
+	defer func(body io.ReadCloser) {
+		err := body.Close()
+		if err != nil {
+			log.Printf("Close failed: %v\n", err)
+		}
+	}(body)
+
+	source, err := newSource(body)
+	if err != nil {
+		log.Printf("Ingest failed: %v\n", err)
+		c.JSON(http.StatusBadRequest, gin.H{"result": "failed"})
+		return
+	}
+
+	result, err := stat.Ingest(source, c.Param("event"), batchSize, options)
+	if err != nil {
+		log.Printf("Ingest failed: %v\n", err)
+		c.JSON(http.StatusInternalServerError, result)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// CollectStream accepts newline-delimited JSON viewers, optionally gzip-compressed,
+// and stores them in batches as they are read.
+func (stat *Stat) CollectStream(c *gin.Context) {
+	stat.ingestRequest(c, func(r io.Reader) (ViewerSource, error) {
+		return NewNDJSONSource(r), nil
+	})
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	xlsxMainNamespace   = "http://schemas.openxmlformats.org/spreadsheetml/2006/main"
+	xlsxRelsNamespace   = "http://schemas.openxmlformats.org/officeDocument/2006/relationships"
+	xlsxMaxSheetName    = 31
+	xlsxHeaderStyle     = 1
+	xlsxDateStyle       = 2
+	xlsxDocumentType    = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument"
+	xlsxWorksheetType   = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet"
+	xlsxStylesType      = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles"
+	xlsxWorkbookContent = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"
+	xlsxSheetContent    = "application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"
+	xlsxStylesContent   = "application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"
+)
+
+// xlsxStyles defines the cell formats referenced by index from the sheets:
+// 0 is the default, 1 the bold header and 2 a date and time.
+const xlsxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="` + xlsxMainNamespace + `">` +
+	`<numFmts count="1"><numFmt numFmtId="164" formatCode="yyyy-mm-dd hh:mm:ss"/></numFmts>` +
+	`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+	`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+	`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+	`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+	`<cellXfs count="3">` +
+	`<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>` +
+	`<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/>` +
+	`<xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`</cellXfs>` +
+	`<cellStyles count="1"><cellStyle name="Normal" xfId="0" builtinId="0"/></cellStyles>` +
+	`</styleSheet>`
+
+// xlsxEpoch is day zero of the date serial numbers used by spreadsheets.
+var xlsxEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+type xlsxTypes struct {
+	XMLName   xml.Name       `xml:"Types"`
+	Xmlns     string         `xml:"xmlns,attr"`
+	Defaults  []xlsxDefault  `xml:"Default"`
+	Overrides []xlsxOverride `xml:"Override"`
+}
+
+type xlsxDefault struct {
+	Extension   string `xml:"Extension,attr"`
+	ContentType string `xml:"ContentType,attr"`
+}
+
+type xlsxOverride struct {
+	PartName    string `xml:"PartName,attr"`
+	ContentType string `xml:"ContentType,attr"`
+}
+
+type xlsxRelationships struct {
+	XMLName       xml.Name           `xml:"Relationships"`
+	Xmlns         string             `xml:"xmlns,attr"`
+	Relationships []xlsxRelationship `xml:"Relationship"`
+}
+
+type xlsxRelationship struct {
+	Id     string `xml:"Id,attr"`
+	Type   string `xml:"Type,attr"`
+	Target string `xml:"Target,attr"`
+}
+
+type xlsxWorkbook struct {
+	XMLName xml.Name    `xml:"workbook"`
+	Xmlns   string      `xml:"xmlns,attr"`
+	XmlnsR  string      `xml:"xmlns:r,attr"`
+	Sheets  []xlsxSheet `xml:"sheets>sheet"`
+}
+
+type xlsxSheet struct {
+	Name    string `xml:"name,attr"`
+	SheetId int    `xml:"sheetId,attr"`
+	Id      string `xml:"r:id,attr"`
+}
+
+type xlsxWorksheet struct {
+	XMLName xml.Name      `xml:"worksheet"`
+	Xmlns   string        `xml:"xmlns,attr"`
+	View    xlsxSheetView `xml:"sheetViews>sheetView"`
+	Rows    []xlsxRow     `xml:"sheetData>row"`
+}
+
+type xlsxSheetView struct {
+	WorkbookViewId int       `xml:"workbookViewId,attr"`
+	Pane           *xlsxPane `xml:"pane,omitempty"`
+}
+
+// xlsxPane keeps the header row visible while scrolling.
+type xlsxPane struct {
+	YSplit      int    `xml:"ySplit,attr"`
+	TopLeftCell string `xml:"topLeftCell,attr"`
+	ActivePane  string `xml:"activePane,attr"`
+	State       string `xml:"state,attr"`
+}
+
+type xlsxRow struct {
+	R     int        `xml:"r,attr"`
+	Cells []xlsxCell `xml:"c"`
+}
+
+type xlsxCell struct {
+	Ref    string      `xml:"r,attr"`
+	Style  int         `xml:"s,attr,omitempty"`
+	Type   string      `xml:"t,attr,omitempty"`
+	Value  string      `xml:"v,omitempty"`
+	Inline *xlsxInline `xml:"is,omitempty"`
+}
+
+type xlsxInline struct {
+	Text string `xml:"t"`
+}
+
+// XLSXRenderer writes tables as an Office Open XML workbook, one sheet per table.
+type XLSXRenderer struct{}
+
+// WorkbookRenderer is implemented by renderers that can hold several tables in one document.
+type WorkbookRenderer interface {
+	Renderer
+	RenderAll(w io.Writer, tables []*Table) error
+}
+
+func (XLSXRenderer) ContentType() string {
+	return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+}
+
+func (renderer XLSXRenderer) Render(w io.Writer, table *Table) error {
+	return renderer.RenderAll(w, []*Table{table})
+}
+
+func (XLSXRenderer) RenderAll(w io.Writer, tables []*Table) error {
+	archive := zip.NewWriter(w)
+	types := xlsxTypes{
+		Xmlns: "http://schemas.openxmlformats.org/package/2006/content-types",
+		Defaults: []xlsxDefault{
+			{Extension: "rels", ContentType: "application/vnd.openxmlformats-package.relationships+xml"},
+			{Extension: "xml", ContentType: "application/xml"},
+		},
+		Overrides: []xlsxOverride{
+			{PartName: "/xl/workbook.xml", ContentType: xlsxWorkbookContent},
+			{PartName: "/xl/styles.xml", ContentType: xlsxStylesContent},
+		},
+	}
+	workbook := xlsxWorkbook{Xmlns: xlsxMainNamespace, XmlnsR: xlsxRelsNamespace}
+	workbookRels := xlsxRelationships{Xmlns: "http://schemas.openxmlformats.org/package/2006/relationships"}
+
+	names := make(map[string]bool)
+	for i, table := range tables {
+		id := i + 1
+		part := "worksheets/sheet" + strconv.Itoa(id) + ".xml"
+		types.Overrides = append(types.Overrides, xlsxOverride{PartName: "/xl/" + part, ContentType: xlsxSheetContent})
+		workbook.Sheets = append(workbook.Sheets, xlsxSheet{Name: xlsxSheetName(table.Name, id, names), SheetId: id, Id: "rId" + strconv.Itoa(id)})
+		workbookRels.Relationships = append(workbookRels.Relationships, xlsxRelationship{Id: "rId" + strconv.Itoa(id), Type: xlsxWorksheetType, Target: part})
+		err := writeXMLPart(archive, "xl/"+part, xlsxSheetOf(table))
+		if err != nil {
+			return err
+		}
+	}
+	workbookRels.Relationships = append(workbookRels.Relationships, xlsxRelationship{Id: "rId" + strconv.Itoa(len(tables)+1), Type: xlsxStylesType, Target: "styles.xml"})
+
+	err := writeXMLPart(archive, "[Content_Types].xml", types)
+	if err != nil {
+		return err
+	}
+	err = writeXMLPart(archive, "_rels/.rels", xlsxRelationships{
+		Xmlns:         "http://schemas.openxmlformats.org/package/2006/relationships",
+		Relationships: []xlsxRelationship{{Id: "rId1", Type: xlsxDocumentType, Target: "xl/workbook.xml"}},
+	})
+	if err != nil {
+		return err
+	}
+	err = writeXMLPart(archive, "xl/workbook.xml", workbook)
+	if err != nil {
+		return err
+	}
+	err = writeXMLPart(archive, "xl/_rels/workbook.xml.rels", workbookRels)
+	if err != nil {
+		return err
+	}
+	styles, err := archive.Create("xl/styles.xml")
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(styles, xlsxStyles)
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+func writeXMLPart(archive *zip.Writer, name string, v interface{}) error {
+	part, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(part, xml.Header)
+	if err != nil {
+		return err
+	}
+	return xml.NewEncoder(part).Encode(v)
+}
+
+// xlsxSheetName makes a valid and unique sheet name: at most 31 characters
+// without any of the characters spreadsheets reserve.
+func xlsxSheetName(name string, id int, used map[string]bool) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" {
+		name = "Sheet" + strconv.Itoa(id)
+	}
+	if runes := []rune(name); len(runes) > xlsxMaxSheetName {
+		name = string(runes[:xlsxMaxSheetName])
+	}
+	unique := name
+	for n := 2; used[strings.ToLower(unique)]; n++ {
+		suffix := " (" + strconv.Itoa(n) + ")"
+		runes := []rune(name)
+		if len(runes)+len(suffix) > xlsxMaxSheetName {
+			runes = runes[:xlsxMaxSheetName-len(suffix)]
+		}
+		unique = string(runes) + suffix
+	}
+	used[strings.ToLower(unique)] = true
+	return unique
+}
+
+// xlsxColumn converts a zero based column index to its letters: A, B, ..., Z, AA, ...
+func xlsxColumn(i int) string {
+	var name []byte
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = append([]byte{byte('A' + (i-1)%26)}, name...)
+	}
+	return string(name)
+}
+
+func xlsxSheetOf(table *Table) xlsxWorksheet {
+	sheet := xlsxWorksheet{
+		Xmlns: xlsxMainNamespace,
+		View:  xlsxSheetView{Pane: &xlsxPane{YSplit: 1, TopLeftCell: "A2", ActivePane: "bottomLeft", State: "frozen"}},
+	}
+	header := xlsxRow{R: 1}
+	for i, column := range table.Columns {
+		header.Cells = append(header.Cells, xlsxCell{Ref: xlsxColumn(i) + "1", Style: xlsxHeaderStyle, Type: "inlineStr", Inline: &xlsxInline{Text: column}})
+	}
+	sheet.Rows = append(sheet.Rows, header)
+	for i, values := range table.Rows {
+		row := xlsxRow{R: i + 2}
+		for j, value := range values {
+			if value == nil {
+				continue
+			}
+			cell := xlsxCellOf(value)
+			cell.Ref = xlsxColumn(j) + strconv.Itoa(row.R)
+			row.Cells = append(row.Cells, cell)
+		}
+		sheet.Rows = append(sheet.Rows, row)
+	}
+	return sheet
+}
+
+// xlsxCellOf stores numbers as numbers and times as date serials in the
+// wall clock of their location. Everything else, including values a
+// spreadsheet cannot represent, is written as text.
+func xlsxCellOf(value interface{}) xlsxCell {
+	switch v := value.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return xlsxCell{Value: fmt.Sprint(v)}
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			break
+		}
+		return xlsxCell{Value: strconv.FormatFloat(v, 'g', -1, 64)}
+	case bool:
+		if v {
+			return xlsxCell{Type: "b", Value: "1"}
+		}
+		return xlsxCell{Type: "b", Value: "0"}
+	case time.Time:
+		wall := time.Date(v.Year(), v.Month(), v.Day(), v.Hour(), v.Minute(), v.Second(), v.Nanosecond(), time.UTC)
+		if wall.Before(xlsxEpoch) {
+			break
+		}
+		days := float64(wall.Sub(xlsxEpoch)) / float64(24*time.Hour)
+		return xlsxCell{Style: xlsxDateStyle, Value: strconv.FormatFloat(days, 'f', -1, 64)}
+	}
+	return xlsxCell{Type: "inlineStr", Inline: &xlsxInline{Text: formatValue(value)}}
+}